@@ -0,0 +1,141 @@
+package multiplex
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/multiformats/go-varint"
+)
+
+// Framer encodes and decodes the messages of a session, in place of the plain
+// mplex encoding, e.g. to compress or checksum payloads. Both sides need to use
+// compatible framers, which the application has to agree on out of band.
+type Framer interface {
+	// WriteFrame writes a message with the given header (stream id and
+	// tag, as in the mplex spec) and payload to w. It should write the
+	// whole message with a single Write, see WithDatagrams.
+	WriteFrame(w io.Writer, header uint64, payload []byte) error
+	// ReadFrame reads the next message from r. It returns io.EOF if r ends
+	// before the message starts. Payloads larger than maxSize must be
+	// rejected. The payload only needs to stay valid until the next call.
+	ReadFrame(r *bufio.Reader, maxSize int) (header uint64, payload []byte, err error)
+}
+
+// WithFramer makes the session encode and decode messages with framer.
+//
+// Framers decode whole messages, so the session's read buffer (see
+// WithReadBufferSize) grows to hold the largest message it accepts (see
+// WithMaxMessageSize), reserved from the MemoryManager.
+func WithFramer(framer Framer) Option {
+	return func(mp *Multiplex) {
+		mp.framer = framer
+	}
+}
+
+// PlainFramer is the plain mplex encoding: a varint header, a varint length and
+// the payload. Sessions use it by default, more efficiently than through the
+// Framer interface; it's for framers that transform payloads and then encode
+// them as usual.
+//
+// ReadFrame returns payloads that fit in r's buffer without copying them; only
+// larger ones get a buffer of their own.
+type PlainFramer struct{}
+
+func (PlainFramer) WriteFrame(w io.Writer, header uint64, payload []byte) error {
+	buf := pool.Get(len(payload) + 2*binary.MaxVarintLen64)
+	defer pool.Put(buf)
+
+	n := binary.PutUvarint(buf, header)
+	n += binary.PutUvarint(buf[n:], uint64(len(payload)))
+	n += copy(buf[n:], payload)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+func (PlainFramer) ReadFrame(r *bufio.Reader, maxSize int) (uint64, []byte, error) {
+	header, err := varint.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	l, err := varint.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if l > uint64(maxSize) {
+		return 0, nil, fmt.Errorf("message size too large: %d > %d", l, maxSize)
+	}
+
+	if int(l) <= r.Size() {
+		// Discard doesn't touch the buffer, so the payload stays
+		// valid until r is next read.
+		payload, err := r.Peek(int(l))
+		if err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		r.Discard(len(payload))
+		return header, payload, nil
+	}
+
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return header, payload, nil
+}
+
+// ErrChecksumMismatch is the session error after receiving a corrupted message,
+// see ChecksumFramer.
+var ErrChecksumMismatch = errors.New("message checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumFramer appends a CRC-32C of each message's header and payload to the
+// payload, and checks it on the way in. A session receiving a corrupted message
+// shuts down with ErrChecksumMismatch: we can't tell which stream it was meant
+// for. Messages are encoded with Framer, or PlainFramer if it's nil.
+type ChecksumFramer struct {
+	Framer Framer
+}
+
+func (f ChecksumFramer) next() Framer {
+	if f.Framer == nil {
+		return PlainFramer{}
+	}
+	return f.Framer
+}
+
+func checksum(header uint64, payload []byte) uint32 {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], header)
+	return crc32.Update(crc32.Checksum(buf[:n], crcTable), crcTable, payload)
+}
+
+func (f ChecksumFramer) WriteFrame(w io.Writer, header uint64, payload []byte) error {
+	buf := pool.Get(len(payload) + 4)
+	defer pool.Put(buf)
+
+	copy(buf, payload)
+	binary.BigEndian.PutUint32(buf[len(payload):], checksum(header, payload))
+	return f.next().WriteFrame(w, header, buf)
+}
+
+func (f ChecksumFramer) ReadFrame(r *bufio.Reader, maxSize int) (uint64, []byte, error) {
+	header, payload, err := f.next().ReadFrame(r, maxSize+4)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) < 4 {
+		return 0, nil, ErrChecksumMismatch
+	}
+
+	payload, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if binary.BigEndian.Uint32(sum) != checksum(header, payload) {
+		return 0, nil, ErrChecksumMismatch
+	}
+	return header, payload, nil
+}
@@ -2,20 +2,24 @@ package multiplex
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pool "github.com/libp2p/go-buffer-pool"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/multiformats/go-varint"
+	"go.uber.org/multierr"
 )
 
 var log = logging.Logger("mplex")
@@ -32,9 +36,20 @@ var (
 	ChunkSize = BufferSize - 20
 )
 
-// Max time to block waiting for a slow reader to read from a stream before
-// resetting it. Preferably, we'd have some form of back-pressure mechanism but
-// we don't have that in this protocol.
+// framedOverhead is the room left in the read buffer of sessions with a Framer
+// for a message's varints and whatever the framer adds to its payload.
+const framedOverhead = 64
+
+// ReceiveTimeout is how long, by default, to block waiting for a slow reader to
+// read from a stream before resetting it (see WithReceiveTimeout). Preferably,
+// we'd have some form of back-pressure mechanism but we don't have that in this
+// protocol.
+//
+// While we wait, no other stream on the session receives data. We don't queue
+// data for slow streams instead: inbound buffers are limited by the memory
+// reserved from the MemoryManager (at most MaxBuffers), so a stalled stream
+// would soon hold all of them and stall the session anyway. Bounding the wait
+// and resetting the offending stream keeps memory use fixed.
 var ReceiveTimeout = 5 * time.Second
 
 // ErrShutdown is returned when operating on a shutdown session
@@ -47,8 +62,43 @@ var ErrTwoInitiators = errors.New("two initiators")
 // In this case, we close the connection to be safe.
 var ErrInvalidState = errors.New("received an unexpected message from the peer")
 
+// ErrNameTooLong is returned when opening a stream with a name longer than the
+// session allows.
+var ErrNameTooLong = errors.New("stream name too long")
+
+// ErrStreamIDsExhausted is returned when opening a stream after all stream ids
+// have been used up.
+var ErrStreamIDsExhausted = errors.New("stream ids exhausted")
+
+// ErrReadTimeout is the session error after nothing was received for longer
+// than the read timeout, see WithReadTimeout.
+var ErrReadTimeout = errors.New("timed out waiting for data from the peer")
+
+// ErrWriteTimeout is the session error after writing to the connection took
+// longer than the write timeout, see WithWriteTimeout.
+var ErrWriteTimeout = errors.New("timed out writing to the connection")
+
+// ErrInvalidFrame is returned by SendFrame for messages that can't be sent.
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// ErrStreamIDInUse is returned when an IDAllocator picks the id of a stream
+// that's still open.
+var ErrStreamIDInUse = errors.New("stream id in use")
+
+// maxStreamID is the largest stream id that still fits in a message header.
+// It's reserved for pings, so we never open a stream with it.
+const maxStreamID = varint.MaxValueUvarint63 >> 3
+
 var errTimeout = timeout{}
 
+// errCanceled is returned when the caller's context is done, to be replaced
+// with the context's error.
+var errCanceled = errors.New("canceled")
+
+// ResetStreamTimeout is how long we wait to queue a close or reset message
+// when the session is busy. There's no way to tell the peer about the stream
+// otherwise, so if a close (or a reset of our own) can't be queued in time,
+// the session is closed.
 var ResetStreamTimeout = 2 * time.Minute
 
 var getInputBufferTimeout = time.Minute
@@ -72,58 +122,428 @@ type nullMemoryManager struct{}
 func (m *nullMemoryManager) ReserveMemory(size int, prio uint8) error { return nil }
 func (m *nullMemoryManager) ReleaseMemory(size int)                   {}
 
-// +1 for initiator
+// Metrics is notified of events on a session, for monitoring. Stream ids are
+// only unique together with the side that opened the stream.
+type Metrics interface {
+	// StreamOpened is called when a stream is opened, by either side.
+	StreamOpened(stream uint64)
+	// StreamClosed is called when a stream stops receiving data, because
+	// it was closed, reset or the session shut down.
+	StreamClosed(stream uint64)
+	// MessageSent is called when a data message of size bytes has been
+	// written to the connection.
+	MessageSent(stream uint64, size int)
+	// MessageReceived is called when a data message of size bytes is
+	// received.
+	MessageReceived(stream uint64, size int)
+	// StreamRejected is called when we reset a stream the peer opens
+	// because it's over one of our limits, e.g. maxStreams.
+	StreamRejected(stream uint64)
+	// SessionClosed is called when the session shuts down, with the error
+	// returned by Err.
+	SessionClosed(err error)
+}
+
+type nullMetrics struct{}
+
+func (nullMetrics) StreamOpened(stream uint64)              {}
+func (nullMetrics) StreamClosed(stream uint64)              {}
+func (nullMetrics) MessageSent(stream uint64, size int)     {}
+func (nullMetrics) MessageReceived(stream uint64, size int) {}
+func (nullMetrics) StreamRejected(stream uint64)            {}
+func (nullMetrics) SessionClosed(err error)                 {}
+
+// Logger is what a session logs to. go-log loggers implement it.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// WithLogger makes the session log to logger, instead of the "mplex" go-log
+// logger.
+func WithLogger(logger Logger) Option {
+	return func(mp *Multiplex) {
+		mp.log = logger
+	}
+}
+
+// WithMetrics reports events on the session to metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(mp *Multiplex) {
+		mp.metrics = metrics
+	}
+}
+
+// MessageTag is the type of an mplex message, kept in the low 3 bits of its
+// header.
+type MessageTag uint64
+
+// Message tags, as defined by the mplex spec. Apart from NewStream, each
+// message type has two tags: the stream's initiator sends the even one, and
+// the receiver sends the one below it. We refer to message types by the
+// initiator's tag; streamID.header picks the right one when sending.
 const (
-	newStreamTag = 0
-	messageTag   = 2
-	closeTag     = 4
-	resetTag     = 6
+	NewStreamTag        MessageTag = 0
+	MessageReceiverTag  MessageTag = 1
+	MessageInitiatorTag MessageTag = 2
+	CloseReceiverTag    MessageTag = 3
+	CloseInitiatorTag   MessageTag = 4
+	ResetReceiverTag    MessageTag = 5
+	ResetInitiatorTag   MessageTag = 6
 )
 
+var tagNames = [...]string{
+	NewStreamTag:        "NewStream",
+	MessageReceiverTag:  "MessageReceiver",
+	MessageInitiatorTag: "MessageInitiator",
+	CloseReceiverTag:    "CloseReceiver",
+	CloseInitiatorTag:   "CloseInitiator",
+	ResetReceiverTag:    "ResetReceiver",
+	ResetInitiatorTag:   "ResetInitiator",
+}
+
+func (t MessageTag) String() string {
+	if t < MessageTag(len(tagNames)) {
+		return tagNames[t]
+	}
+	return fmt.Sprintf("MessageTag(%d)", uint64(t))
+}
+
+// EncodeHeader returns the header of a message with the given tag on the
+// stream with the given id. Headers are uvarints of at most 63 bits, so ids
+// must fit in 60 bits, and tags in 3. Neither is checked: larger values are
+// silently cut off.
+func EncodeHeader(id uint64, tag MessageTag) uint64 {
+	return id<<3 | uint64(tag&7)
+}
+
+// DecodeHeader splits a message header into a stream id and a tag.
+func DecodeHeader(h uint64) (id uint64, tag MessageTag) {
+	return h >> 3, MessageTag(h & 7)
+}
+
+// outMsg is a framed message queued for the write loop.
+type outMsg struct {
+	header uint64
+	size   int // of the message payload
+	// data is the encoded message, or only its payload if the session has
+	// a Framer.
+	data []byte
+	// ack, if non-nil, receives the result of writing data to the
+	// connection. It must be buffered.
+	ack chan<- error
+	// flush marks a message with nothing to write, queued to find out when
+	// everything queued before it has been written. It has no buffer.
+	flush bool
+}
+
+// Option configures a Multiplex at construction time.
+type Option func(*Multiplex)
+
+// WithMaxMessageSize sets the largest message the session accepts from the
+// peer. Larger messages cause the session to shut down. It defaults to
+// MaxMessageSize. NewMultiplex fails if size isn't positive.
+func WithMaxMessageSize(size int) Option {
+	return func(mp *Multiplex) {
+		mp.maxMessageSize = size
+	}
+}
+
+// WithWriteBufferSize sets the size of the buffer used to coalesce outgoing
+// frames before writing them to the connection. A size of 0 disables
+// buffering. It defaults to BufferSize.
+func WithWriteBufferSize(size int) Option {
+	return func(mp *Multiplex) {
+		mp.writeBufferSize = size
+	}
+}
+
+// WithReadBufferSize sets the size of the buffer the read loop reads the
+// connection through. A larger buffer means fewer reads from the connection,
+// a smaller one saves memory on idle sessions. It defaults to BufferSize.
+func WithReadBufferSize(size int) Option {
+	return func(mp *Multiplex) {
+		mp.readBufferSize = size
+	}
+}
+
+// WithChunkSize sets the largest message the session sends. Writes larger than
+// this are split into several messages. It defaults to ChunkSize, and must not
+// exceed the peer's maximum message size. Up to MaxBuffers chunks may be
+// queued for writing at once, so larger chunks mean more memory in flight,
+// reserved from the MemoryManager. NewMultiplex fails if size isn't positive.
+func WithChunkSize(size int) Option {
+	return func(mp *Multiplex) {
+		mp.chunkSize = size
+	}
+}
+
+// WithReceiveQueueLength sets how many received chunks each stream queues for
+// its reader before the read loop has to wait for it. It defaults to 1; with
+// 0, the read loop hands each chunk straight to a waiting reader. NewMultiplex
+// fails if length is negative.
+//
+// Deeper queues let a busy stream absorb bursts without holding up the read
+// loop, but they don't raise the session's memory use: queued chunks come out
+// of the inbound buffers reserved from the MemoryManager (at most MaxBuffers
+// of BufferSize bytes, shared by all streams). A stream with a deep queue and
+// a slow reader can hold all of them, stalling the other streams until it
+// catches up or is reset.
+func WithReceiveQueueLength(length int) Option {
+	return func(mp *Multiplex) {
+		mp.receiveQueueLength = length
+	}
+}
+
+// WithStreamIdleTimeout resets streams that go unused for timeout: nothing was
+// read from them, written to them or received on them. By default, streams are
+// never reset for being idle.
+func WithStreamIdleTimeout(timeout time.Duration) Option {
+	return func(mp *Multiplex) {
+		mp.idleTimeout = timeout
+	}
+}
+
+// WithReadTimeout shuts the session down with ErrReadTimeout if we wait for
+// longer than timeout for the peer to send anything. Time spent waiting for
+// streams to accept data doesn't count. Use WithKeepAlive to make sure an idle
+// but healthy peer doesn't time out. By default, we wait forever.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(mp *Multiplex) {
+		mp.readTimeout = timeout
+	}
+}
+
+// WithWriteTimeout shuts the session down with ErrWriteTimeout if writing to
+// the connection takes longer than timeout, so a stalled connection fails
+// pending writes instead of blocking all streams forever. By default, we wait
+// forever.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(mp *Multiplex) {
+		mp.writeTimeout = timeout
+	}
+}
+
+// WithWriteErrorHandler makes the session call handler when writing to the
+// connection fails, unless the session was already shutting down. The session
+// shuts down with the error once handler returns: we can't know how much of the
+// failed write made it to the peer, so there's no carrying on. handler is
+// called at most once, from the write loop, so it must not block on writes.
+func WithWriteErrorHandler(handler func(error)) Option {
+	return func(mp *Multiplex) {
+		mp.writeErrorHandler = handler
+	}
+}
+
+// WithDatagrams runs the session over a message-oriented connection, where
+// each read returns one whole packet and each write sends one. Packets must
+// arrive reliably and in order, each holding one or more whole messages. Every
+// message we send goes out in a packet of its own.
+//
+// The session reserves a buffer large enough for the largest packet it
+// accepts, see WithMaxMessageSize.
+func WithDatagrams() Option {
+	return func(mp *Multiplex) {
+		mp.datagrams = true
+	}
+}
+
+// IDAllocator picks the id of the next stream we open. Ids only need to be
+// unique among the streams we open, the peer's streams have ids of their own.
+type IDAllocator func() (uint64, error)
+
+// WithIDAllocator makes the session use alloc to pick the ids of the streams we
+// open, instead of counting up from 0. alloc is called with the session's
+// stream lock held, so it must not call back into the session. If it picks the
+// id of a stream we still have open, opening the stream fails with
+// ErrStreamIDInUse.
+func WithIDAllocator(alloc IDAllocator) Option {
+	return func(mp *Multiplex) {
+		mp.allocID = alloc
+	}
+}
+
+// WithReceiveTimeout sets how long the session waits for a slow reader before
+// resetting its stream, instead of ReceiveTimeout.
+func WithReceiveTimeout(timeout time.Duration) Option {
+	return func(mp *Multiplex) {
+		mp.receiveTimeout = timeout
+	}
+}
+
+// WithReadLimit limits how much a single Read on the session's streams returns,
+// even if more has been received and the buffer passed to Read is larger, so
+// that callers get to act on data sooner. By default, Read fills as much of
+// the buffer as it can without waiting.
+func WithReadLimit(size int) Option {
+	return func(mp *Multiplex) {
+		mp.readLimit = size
+	}
+}
+
+// WithAcceptFilter makes the session check the name of each stream the peer
+// opens with accept, and reset the stream right away if it returns false. The
+// stream is never registered, so Accept doesn't see it. accept is called from
+// the read loop, which waits for it: it must not block.
+//
+// Streams that pass keep their name, see Stream.Name; without a filter,
+// streams the peer opens have no name. Unless WithMaxStreamNameLength says
+// otherwise, names longer than BufferSize are refused without being read.
+func WithAcceptFilter(accept func(name string) bool) Option {
+	return func(mp *Multiplex) {
+		mp.acceptFilter = accept
+	}
+}
+
+// WithStreamsHint presizes the session's stream table for about n streams open
+// at once, saving it from growing under load. It's only a hint.
+func WithStreamsHint(n int) Option {
+	return func(mp *Multiplex) {
+		mp.streamsHint = n
+	}
+}
+
+// WithMaxStreamNameLength limits the length of stream names, both for streams
+// we open and for streams the peer opens. Streams the peer opens with longer
+// names are reset. By default, names are only limited by the message size.
+func WithMaxStreamNameLength(length int) Option {
+	return func(mp *Multiplex) {
+		mp.maxNameLength = length
+	}
+}
+
 // Multiplex is a mplex session.
 type Multiplex struct {
+	// stats comes first so its counters are 64-bit aligned, as atomic
+	// operations need on 32-bit platforms.
+	stats counters
+
 	con       io.ReadWriteCloser
 	buf       *bufio.Reader
+	wbuf      *bufio.Writer // nil if writes aren't buffered
 	nextID    uint64
+	allocID   IDAllocator
 	initiator bool
 
+	// laddr and raddr are con's addresses, or nil if it doesn't have any.
+	laddr, raddr net.Addr
+
 	memoryManager MemoryManager
+	metrics       Metrics
+	log           Logger
 
 	closed       chan struct{}
 	shutdown     chan struct{}
 	shutdownErr  error
 	shutdownLock sync.Mutex
+	wg           sync.WaitGroup // see spawn
 
-	writeCh  chan []byte
-	nstreams chan *Stream
+	// closeErr is the error that made us shut down the session, if any.
+	// Guarded by shutdownLock.
+	closeErr error
+
+	// writeCh and writeChHigh queue messages for writing, the latter
+	// those of PriorityHigh streams
+	writeCh, writeChHigh chan outMsg
+	nstreams             chan *Stream
 
 	channels map[streamID]*Stream
-	chLock   sync.Mutex
+	// writers holds the streams we can still write to, including those
+	// the peer has closed, which are no longer in channels. Guarded by
+	// chLock.
+	writers  map[streamID]*Stream
+	chLock   sync.RWMutex
+	draining bool // set by CloseGraceful and Shutdown, guarded by chLock
+	// drained is closed once a session being shut down has no streams
+	// left, see Shutdown. Guarded by chLock.
+	drained chan struct{}
 
 	bufIn, bufOut  chan struct{}
 	bufInTimer     *time.Timer
 	reservedMemory int
 
-	numStreams uint32
-	maxStreams uint32
+	numStreams  uint32 // streams opened by the peer, guarded by chLock
+	maxStreams  uint32
+	streamsHint int
+
+	maxMessageSize  int
+	chunkSize       int
+	readBufferSize  int
+	writeBufferSize int
+	maxNameLength   int
+	acceptFilter    func(name string) bool
+
+	receiveQueueLength int
+	receiveTimeout     time.Duration
+	readLimit          int
+	idleTimeout        time.Duration
+
+	pingLock  sync.Mutex
+	pingNonce uint64
+	pings     map[uint64]chan struct{}
+	ponging   int32 // 1 while answering a ping, accessed atomically
+
+	// rejects queues the resets of streams the peer opened that we refused,
+	// see rejectStream.
+	rejects   chan streamID
+	rejecting int32 // 1 while sending resets from rejects, accessed atomically
+
+	keepAliveInterval time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	writeTimer        *time.Timer // only used by the write loop
+	writeErrorHandler func(error)
+	datagrams         bool
+	framer            Framer
+
+	// frame holds the rest of the message being read, if the session has a
+	// Framer. Only used by the read loop.
+	frame bytes.Reader
 }
 
-// NewMultiplex creates a new multiplexer session.
-func NewMultiplex(con io.ReadWriteCloser, initiator bool, memoryManager MemoryManager, maxStreams uint32) (*Multiplex, error) {
+// NewMultiplex creates a new multiplexer session. The peer may have at most
+// maxStreams streams open at once; any more it opens are reset right away.
+func NewMultiplex(con io.ReadWriteCloser, initiator bool, memoryManager MemoryManager, maxStreams uint32, opts ...Option) (*Multiplex, error) {
 	if memoryManager == nil {
 		memoryManager = &nullMemoryManager{}
 	}
 	mp := &Multiplex{
 		con:           con,
 		initiator:     initiator,
-		channels:      make(map[streamID]*Stream),
 		closed:        make(chan struct{}),
 		shutdown:      make(chan struct{}),
 		nstreams:      make(chan *Stream, 16),
 		memoryManager: memoryManager,
+		metrics:       nullMetrics{},
+		log:           log,
 		numStreams:    0,
 		maxStreams:    maxStreams,
+
+		maxMessageSize:  MaxMessageSize,
+		chunkSize:       ChunkSize,
+		readBufferSize:  BufferSize,
+		writeBufferSize: BufferSize,
+
+		receiveQueueLength: 1,
+		receiveTimeout:     ReceiveTimeout,
+		pings:              make(map[uint64]chan struct{}),
+		rejects:            make(chan streamID, maxPendingRejects),
+	}
+	mp.allocID = mp.nextChanID
+	for _, opt := range opts {
+		opt(mp)
+	}
+	if mp.maxMessageSize <= 0 {
+		return nil, fmt.Errorf("invalid max message size: %d", mp.maxMessageSize)
+	}
+	if mp.chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size: %d", mp.chunkSize)
 	}
+	if mp.receiveQueueLength < 0 {
+		return nil, fmt.Errorf("invalid receive queue length: %d", mp.receiveQueueLength)
+	}
+	mp.channels = make(map[streamID]*Stream, mp.streamsHint)
+	mp.writers = make(map[streamID]*Stream, mp.streamsHint)
 
 	// up-front reserve memory for the essential buffers (1 input, 1 output + the reader buffer)
 	if err := mp.memoryManager.ReserveMemory(MinMemoryReservation, 255); err != nil {
@@ -133,6 +553,47 @@ func NewMultiplex(con io.ReadWriteCloser, initiator bool, memoryManager MemoryMa
 	mp.reservedMemory += MinMemoryReservation
 	bufs := 1
 
+	// Framers decode whole messages, so the reader buffer has to hold the
+	// largest one.
+	if mp.framer != nil && mp.readBufferSize < mp.maxMessageSize+framedOverhead {
+		mp.readBufferSize = mp.maxMessageSize + framedOverhead
+	}
+
+	// the minimum reservation covers a BufferSize reader buffer
+	if extra := mp.readBufferSize - BufferSize; extra > 0 {
+		if err := mp.memoryManager.ReserveMemory(extra, 255); err != nil {
+			mp.memoryManager.ReleaseMemory(mp.reservedMemory)
+			return nil, err
+		}
+		mp.reservedMemory += extra
+	}
+
+	// Outbound buffers hold a whole chunk and its header, which may not fit
+	// in BufferSize with a larger chunk size.
+	outBufSize := BufferSize
+	if size := mp.chunkSize + 20; size > outBufSize {
+		outBufSize = size
+	}
+	if extra := outBufSize - BufferSize; extra > 0 {
+		if err := mp.memoryManager.ReserveMemory(extra, 255); err != nil {
+			mp.memoryManager.ReleaseMemory(mp.reservedMemory)
+			return nil, err
+		}
+		mp.reservedMemory += extra
+	}
+
+	// Packets can't be read in pieces, so we need room for the largest one.
+	var packetBuf []byte
+	if mp.datagrams {
+		size := mp.maxMessageSize + 20
+		if err := mp.memoryManager.ReserveMemory(size, 255); err != nil {
+			mp.memoryManager.ReleaseMemory(mp.reservedMemory)
+			return nil, err
+		}
+		mp.reservedMemory += size
+		packetBuf = make([]byte, size)
+	}
+
 	// reserve some more memory for buffers if possible
 	for i := 1; i < MaxBuffers; i++ {
 		var prio uint8
@@ -142,16 +603,40 @@ func NewMultiplex(con io.ReadWriteCloser, initiator bool, memoryManager MemoryMa
 			prio = 128
 		}
 
-		// 2xBufferSize -- one for input and one for output
-		if err := mp.memoryManager.ReserveMemory(2*BufferSize, prio); err != nil {
+		// one for input and one for output
+		if err := mp.memoryManager.ReserveMemory(BufferSize+outBufSize, prio); err != nil {
 			break
 		}
-		mp.reservedMemory += 2 * BufferSize
+		mp.reservedMemory += BufferSize + outBufSize
 		bufs++
 	}
 
-	mp.buf = bufio.NewReaderSize(con, BufferSize)
-	mp.writeCh = make(chan []byte, bufs)
+	// buffering writes is nice to have, skip it if memory is tight, or if
+	// messages need to go out one packet at a time
+	if mp.writeBufferSize > 0 && !mp.datagrams {
+		if err := mp.memoryManager.ReserveMemory(mp.writeBufferSize, 128); err == nil {
+			mp.reservedMemory += mp.writeBufferSize
+			mp.wbuf = bufio.NewWriterSize(con, mp.writeBufferSize)
+		}
+	}
+
+	if c, ok := con.(interface{ LocalAddr() net.Addr }); ok {
+		mp.laddr = c.LocalAddr()
+	}
+	if c, ok := con.(interface{ RemoteAddr() net.Addr }); ok {
+		mp.raddr = c.RemoteAddr()
+	}
+
+	var r io.Reader = con
+	if mp.readTimeout > 0 {
+		r = &timeoutReader{r: r, mp: mp}
+	}
+	if mp.datagrams {
+		r = &packetReader{r: r, buf: packetBuf}
+	}
+	mp.buf = bufio.NewReaderSize(r, mp.readBufferSize)
+	mp.writeCh = make(chan outMsg, bufs)
+	mp.writeChHigh = make(chan outMsg, bufs)
 	mp.bufIn = make(chan struct{}, bufs)
 	mp.bufOut = make(chan struct{}, bufs)
 	mp.bufInTimer = time.NewTimer(0)
@@ -159,8 +644,18 @@ func NewMultiplex(con io.ReadWriteCloser, initiator bool, memoryManager MemoryMa
 		<-mp.bufInTimer.C
 	}
 
-	go mp.handleIncoming()
-	go mp.handleOutgoing()
+	mp.wg.Add(2)
+	go func() {
+		defer mp.wg.Done()
+		mp.handleIncoming()
+	}()
+	go func() {
+		defer mp.wg.Done()
+		mp.handleOutgoing()
+	}()
+	if mp.keepAliveInterval > 0 {
+		mp.spawn(mp.keepAlive)
+	}
 
 	return mp, nil
 }
@@ -169,18 +664,34 @@ func (mp *Multiplex) newStream(id streamID, name string) (s *Stream) {
 	s = &Stream{
 		id:          id,
 		name:        name,
-		dataIn:      make(chan []byte, 1),
+		dataIn:      make(chan received, mp.receiveQueueLength),
 		rDeadline:   makePipeDeadline(),
 		wDeadline:   makePipeDeadline(),
 		mp:          mp,
 		writeCancel: make(chan struct{}),
 		readCancel:  make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	if mp.idleTimeout > 0 {
+		// markClosed may reach for the timer as soon as it fires.
+		s.clLock.Lock()
+		s.idleTimer = time.AfterFunc(mp.idleTimeout, func() {
+			mp.log.Debugf("resetting idle stream: %d", id.id)
+			s.Reset()
+		})
+		s.clLock.Unlock()
 	}
 	return
 }
 
 // Accept accepts the next stream from the connection.
 func (m *Multiplex) Accept() (*Stream, error) {
+	return m.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept, but gives up once ctx is done, returning ctx's
+// error. A stream that arrives in the meantime is left for the next call.
+func (m *Multiplex) AcceptContext(ctx context.Context) (*Stream, error) {
 	select {
 	case s, ok := <-m.nstreams:
 		if !ok {
@@ -189,6 +700,8 @@ func (m *Multiplex) Accept() (*Stream, error) {
 		return s, nil
 	case <-m.closed:
 		return nil, m.shutdownErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
@@ -202,6 +715,136 @@ func (mp *Multiplex) Close() error {
 	return nil
 }
 
+// WaitClosed waits for the session to shut down, and for all of its goroutines
+// to exit. It doesn't close the session, see Close.
+func (mp *Multiplex) WaitClosed() {
+	mp.wg.Wait()
+}
+
+// spawn runs f in a goroutine WaitClosed waits for. Once the session is shutting
+// down, f isn't run at all: everything spawned this way is pointless by then.
+// spawn reports whether f was run.
+func (mp *Multiplex) spawn(f func()) bool {
+	mp.shutdownLock.Lock()
+	defer mp.shutdownLock.Unlock()
+	if isClosedChan(mp.shutdown) {
+		return false
+	}
+
+	mp.wg.Add(1)
+	go func() {
+		defer mp.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// closeWithError shuts down the session because of err, which is reported to
+// streams and by Err.
+func (mp *Multiplex) closeWithError(err error) {
+	mp.shutdownLock.Lock()
+	if mp.closeErr == nil && !isClosedChan(mp.shutdown) {
+		mp.closeErr = err
+	}
+	mp.shutdownLock.Unlock()
+	mp.closeNoWait()
+}
+
+// CloseGraceful closes the session, making sure the peer receives everything
+// we sent first. It stops opening new streams, closes all streams for writing
+// and waits for the queued messages to be written before closing the
+// connection. If ctx is done first, the session is closed anyway and ctx's
+// error is returned.
+func (mp *Multiplex) CloseGraceful(ctx context.Context) error {
+	defer mp.Close()
+
+	// Close every stream we can still write to, including those the peer
+	// has already closed.
+	mp.chLock.Lock()
+	mp.draining = true
+	streams := make([]*Stream, 0, len(mp.writers))
+	for _, s := range mp.writers {
+		streams = append(streams, s)
+	}
+	mp.chLock.Unlock()
+
+	// Each stream's messages are written in order, so once its close
+	// message has been written, so has everything it queued before.
+	acks := make(chan error, len(streams))
+	pending := 0
+	for _, s := range streams {
+		if !s.cancelWrite(ErrStreamClosed) {
+			continue
+		}
+		err := s.sendMsgAck(ctx.Done(), nil, s.id.header(CloseInitiatorTag), nil, acks)
+		if err != nil {
+			if err == errTimeout {
+				return ctx.Err()
+			}
+			return err
+		}
+		pending++
+	}
+
+	for ; pending > 0; pending-- {
+		select {
+		case err := <-acks:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-mp.shutdown:
+			return mp.closeError()
+		}
+	}
+
+	// Write whatever else was queued, such as the messages of streams
+	// that were already closed for writing.
+	if err := mp.flush(ctx.Done(), nil); err != nil {
+		if err == errTimeout {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// Shutdown closes the session once its streams are done. It stops opening new
+// streams, and resets any the peer opens, but lets the open streams carry on
+// until they're closed or reset. Then it closes the session. If ctx is done
+// first, the session is closed anyway and ctx's error is returned.
+func (mp *Multiplex) Shutdown(ctx context.Context) error {
+	defer mp.Close()
+
+	mp.chLock.Lock()
+	mp.draining = true
+	if mp.drained == nil {
+		mp.drained = make(chan struct{})
+		mp.checkDrained()
+	}
+	drained := mp.drained
+	mp.chLock.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-mp.shutdown:
+		return mp.closeError()
+	}
+
+	// The last streams may have been closed before their close messages
+	// were written.
+	if err := mp.flush(ctx.Done(), nil); err != nil {
+		if err == errTimeout {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
 func (mp *Multiplex) closeNoWait() {
 	mp.shutdownLock.Lock()
 	select {
@@ -214,6 +857,18 @@ func (mp *Multiplex) closeNoWait() {
 	mp.shutdownLock.Unlock()
 }
 
+// Err returns the error that caused the session to shut down, or nil if it's
+// still open. It returns io.EOF if the peer closed the connection, and
+// ErrShutdown if the session was closed with Close.
+func (mp *Multiplex) Err() error {
+	select {
+	case <-mp.closed:
+		return mp.shutdownErr
+	default:
+		return nil
+	}
+}
+
 // IsClosed returns true if the session is closed.
 func (mp *Multiplex) IsClosed() bool {
 	select {
@@ -224,24 +879,81 @@ func (mp *Multiplex) IsClosed() bool {
 	}
 }
 
+// unknownAddr stands in for the address of a connection that doesn't have one.
+type unknownAddr struct{}
+
+func (unknownAddr) Network() string { return "unknown" }
+func (unknownAddr) String() string  { return "unknown" }
+
+// LocalAddr returns the local address of the underlying connection. If the
+// connection doesn't have addresses, e.g. because it isn't a net.Conn, the
+// address is a placeholder with network "unknown".
+func (mp *Multiplex) LocalAddr() net.Addr {
+	if mp.laddr == nil {
+		return unknownAddr{}
+	}
+	return mp.laddr
+}
+
+// RemoteAddr returns the remote address of the underlying connection, like
+// LocalAddr.
+func (mp *Multiplex) RemoteAddr() net.Addr {
+	if mp.raddr == nil {
+		return unknownAddr{}
+	}
+	return mp.raddr
+}
+
 // CloseChan returns a read-only channel which will be closed when the session is closed
 func (mp *Multiplex) CloseChan() <-chan struct{} {
 	return mp.closed
 }
 
+// SendFrame queues a raw message with the given stream id and tag for the peer,
+// for experimenting with protocol extensions. The tag must fit in 3 bits, and
+// data can't be larger than the chunk size.
+//
+// SendFrame bypasses the session's bookkeeping: sending messages for streams
+// that are open, or opening streams this way, can easily confuse both sides.
+func (mp *Multiplex) SendFrame(ctx context.Context, id uint64, tag MessageTag, data []byte) error {
+	if tag > 7 || id > maxStreamID || len(data) > mp.chunkSize {
+		return ErrInvalidFrame
+	}
+
+	err := mp.sendMsg(ctx.Done(), nil, EncodeHeader(id, tag), data)
+	if err == errTimeout {
+		return ctx.Err()
+	}
+	return err
+}
+
 func (mp *Multiplex) sendMsg(timeout, cancel <-chan struct{}, header uint64, data []byte) error {
-	buf, err := mp.getBufferOutbound(len(data)+20, timeout, cancel)
+	return mp.sendMsgAck(timeout, cancel, header, data, nil)
+}
+
+// sendMsgAck queues a message for writing. If ack is non-nil, the result of
+// writing the message to the connection is delivered on it.
+func (mp *Multiplex) sendMsgAck(timeout, cancel <-chan struct{}, header uint64, data []byte, ack chan<- error) error {
+	return mp.queueMsg(mp.writeCh, timeout, cancel, nil, header, data, ack)
+}
+
+// queueMsg is like sendMsgAck, but queues the message on the given write
+// queue, see Priority. It also gives up with errCanceled once done is closed.
+func (mp *Multiplex) queueMsg(queue chan<- outMsg, timeout, cancel, done <-chan struct{}, header uint64, data []byte, ack chan<- error) error {
+	buf, err := mp.getBufferOutbound(len(data)+20, timeout, cancel, done)
 	if err != nil {
 		return err
 	}
 
 	n := 0
-	n += binary.PutUvarint(buf[n:], header)
-	n += binary.PutUvarint(buf[n:], uint64(len(data)))
+	if mp.framer == nil {
+		n += binary.PutUvarint(buf[n:], header)
+		n += binary.PutUvarint(buf[n:], uint64(len(data)))
+	}
 	n += copy(buf[n:], data)
 
 	select {
-	case mp.writeCh <- buf[:n]:
+	case queue <- outMsg{header: header, size: len(data), data: buf[:n], ack: ack}:
 		return nil
 	case <-mp.shutdown:
 		mp.putBufferOutbound(buf)
@@ -252,50 +964,190 @@ func (mp *Multiplex) sendMsg(timeout, cancel <-chan struct{}, header uint64, dat
 	case <-cancel:
 		mp.putBufferOutbound(buf)
 		return ErrStreamClosed
+	case <-done:
+		mp.putBufferOutbound(buf)
+		return errCanceled
 	}
 }
 
+// flush waits until every message queued so far has been written to the
+// connection.
+func (mp *Multiplex) flush(timeout, cancel <-chan struct{}) error {
+	// Each queue is written in order, but not in order with the others.
+	for _, queue := range []chan outMsg{mp.writeChHigh, mp.writeCh} {
+		ack := make(chan error, 1)
+		select {
+		case queue <- outMsg{ack: ack, flush: true}:
+		case <-mp.shutdown:
+			return ErrShutdown
+		case <-timeout:
+			return errTimeout
+		case <-cancel:
+			return ErrStreamClosed
+		}
+
+		select {
+		case err := <-ack:
+			if err != nil {
+				return err
+			}
+		case <-mp.shutdown:
+			return mp.closeError()
+		}
+	}
+	return nil
+}
+
 func (mp *Multiplex) handleOutgoing() {
 	defer func() {
 		if rerr := recover(); rerr != nil {
 			fmt.Fprintf(os.Stderr, "caught panic in handleOutgoing: %s\n%s\n", rerr, debug.Stack())
+			// Nobody would write anything anymore.
+			mp.closeWithError(fmt.Errorf("caught panic in handleOutgoing: %v", rerr))
 		}
 	}()
 
+	batch := make([]outMsg, 0, cap(mp.writeCh)+cap(mp.writeChHigh))
+
 	for {
 		select {
 		case <-mp.shutdown:
 			return
 
-		case data := <-mp.writeCh:
-			err := mp.doWriteMsg(data)
-			mp.putBufferOutbound(data)
-			if err != nil {
-				// the connection is closed by this time
-				log.Warnf("error writing data: %s", err.Error())
-				return
+		case msg := <-mp.writeChHigh:
+			batch = append(batch[:0], msg)
+		case msg := <-mp.writeCh:
+			// High priority messages go first, even if they were
+			// queued later.
+			batch = drainQueue(batch[:0], mp.writeChHigh, cap(batch)-1)
+			batch = append(batch, msg)
+		}
+
+		// Pick up anything else that's already queued so we can write
+		// it all at once, high priority messages first. A stream's
+		// messages all go through the same queue, so this doesn't
+		// reorder them.
+		batch = drainQueue(batch, mp.writeChHigh, cap(batch))
+		batch = drainQueue(batch, mp.writeCh, cap(batch))
+
+		err := mp.doWriteMsgs(batch)
+		for _, msg := range batch {
+			if msg.flush {
+				msg.ack <- err
+				continue
+			}
+			if err == nil {
+				atomic.AddUint64(&mp.stats.framesSent, 1)
+			}
+			if id, tag := DecodeHeader(msg.header); err == nil && (tag == MessageInitiatorTag || tag == MessageReceiverTag) {
+				atomic.AddUint64(&mp.stats.bytesSent, uint64(msg.size))
+				mp.metrics.MessageSent(id, msg.size)
 			}
+			mp.putBufferOutbound(msg.data)
+			if msg.ack != nil {
+				msg.ack <- err
+			}
+		}
+		if err != nil {
+			// the connection is closed by this time
+			mp.log.Warnf("error writing data: %s", err.Error())
+			return
+		}
+	}
+}
+
+// drainQueue appends the messages waiting in queue to batch, until batch holds
+// max messages.
+func drainQueue(batch []outMsg, queue <-chan outMsg, max int) []outMsg {
+	for len(batch) < max {
+		select {
+		case msg := <-queue:
+			batch = append(batch, msg)
+		default:
+			return batch
 		}
 	}
+	return batch
 }
 
-func (mp *Multiplex) doWriteMsg(data []byte) error {
+// doWriteMsgs writes a batch of framed messages to the connection. When writes
+// are buffered, the batch is flushed before returning, so nothing is left
+// sitting in the buffer while the write loop is idle.
+func (mp *Multiplex) doWriteMsgs(batch []outMsg) error {
 	if mp.isShutdown() {
 		return ErrShutdown
 	}
 
-	_, err := mp.con.Write(data)
+	if mp.writeTimeout > 0 {
+		if mp.writeTimer == nil {
+			mp.writeTimer = time.AfterFunc(mp.writeTimeout, func() {
+				mp.closeWithError(ErrWriteTimeout)
+			})
+		} else {
+			mp.writeTimer.Reset(mp.writeTimeout)
+		}
+		defer mp.writeTimer.Stop()
+	}
+
+	err := mp.writeBatch(batch)
 	if err != nil {
-		mp.closeNoWait()
+		if mp.writeErrorHandler != nil && !mp.isShutdown() {
+			mp.writeErrorHandler(err)
+		}
+		mp.closeWithError(err)
 	}
 
 	return err
 }
 
-func (mp *Multiplex) nextChanID() uint64 {
+func (mp *Multiplex) writeBatch(batch []outMsg) error {
+	var w io.Writer = mp.con
+	if mp.wbuf != nil {
+		w = mp.wbuf
+	}
+
+	for _, msg := range batch {
+		if msg.flush {
+			continue
+		}
+
+		var err error
+		if mp.framer != nil {
+			err = mp.framer.WriteFrame(w, msg.header, msg.data)
+		} else {
+			_, err = w.Write(msg.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if mp.wbuf != nil {
+		return mp.wbuf.Flush()
+	}
+	return nil
+}
+
+// closeError returns the error we shut down the session with, or ErrShutdown
+// if the session was shut down for some other reason.
+func (mp *Multiplex) closeError() error {
+	mp.shutdownLock.Lock()
+	defer mp.shutdownLock.Unlock()
+	if mp.closeErr != nil {
+		return mp.closeErr
+	}
+	return ErrShutdown
+}
+
+func (mp *Multiplex) nextChanID() (uint64, error) {
+	// Never wrap around, that could reuse the id of a stream that's still
+	// open.
+	if mp.nextID >= maxStreamID {
+		return 0, ErrStreamIDsExhausted
+	}
 	out := mp.nextID
 	mp.nextID++
-	return out
+	return out, nil
 }
 
 // NewStream creates a new stream.
@@ -309,26 +1161,51 @@ func (mp *Multiplex) NewNamedStream(ctx context.Context, name string) (*Stream,
 
 	// We could call IsClosed but this is faster (given that we already have
 	// the lock).
-	if mp.channels == nil {
+	if mp.channels == nil || mp.draining {
 		mp.chLock.Unlock()
 		return nil, ErrShutdown
 	}
 
-	sid := mp.nextChanID()
-	header := (sid << 3) | newStreamTag
+	sid, err := mp.allocID()
+	if err != nil {
+		mp.chLock.Unlock()
+		return nil, err
+	}
+	// Larger ids don't fit in a header, or are reserved.
+	if sid >= maxStreamID {
+		mp.chLock.Unlock()
+		return nil, ErrStreamIDsExhausted
+	}
+	if _, ok := mp.channels[streamID{id: sid, initiator: true}]; ok {
+		mp.chLock.Unlock()
+		return nil, ErrStreamIDInUse
+	}
+
+	header := EncodeHeader(sid, NewStreamTag)
 
 	if name == "" {
 		name = fmt.Sprint(sid)
 	}
+	if len(name) > mp.chunkSize || (mp.maxNameLength > 0 && len(name) > mp.maxNameLength) {
+		mp.chLock.Unlock()
+		return nil, ErrNameTooLong
+	}
 	s := mp.newStream(streamID{
 		id:        sid,
 		initiator: true,
 	}, name)
 	mp.channels[s.id] = s
+	mp.writers[s.id] = s
 	mp.chLock.Unlock()
+	atomic.AddUint64(&mp.stats.streamsOpened, 1)
+	mp.metrics.StreamOpened(sid)
+	mp.log.Debugf("opening stream: %d", sid)
 
-	err := mp.sendMsg(ctx.Done(), nil, header, []byte(name))
+	err = mp.sendMsg(ctx.Done(), nil, header, []byte(name))
 	if err != nil {
+		// Forget the stream, the peer never heard about it.
+		mp.unregisterStream(s.id)
+
 		if err == errTimeout {
 			return nil, ctx.Err()
 		}
@@ -338,37 +1215,151 @@ func (mp *Multiplex) NewNamedStream(ctx context.Context, name string) (*Stream,
 	return s, nil
 }
 
+// unregisterStream stops delivering data to a stream, if we still are.
+func (mp *Multiplex) unregisterStream(id streamID) {
+	mp.chLock.Lock()
+	_, ok := mp.channels[id]
+	if ok {
+		delete(mp.channels, id)
+		if !id.initiator {
+			mp.numStreams--
+		}
+		mp.checkDrained()
+	}
+	mp.chLock.Unlock()
+
+	if ok {
+		atomic.AddUint64(&mp.stats.streamsClosed, 1)
+		mp.metrics.StreamClosed(id.id)
+	}
+}
+
+// unregisterWriter forgets a stream once it's closed for writing.
+func (mp *Multiplex) unregisterWriter(id streamID) {
+	mp.chLock.Lock()
+	if _, ok := mp.writers[id]; ok {
+		delete(mp.writers, id)
+		mp.checkDrained()
+	}
+	mp.chLock.Unlock()
+}
+
+// checkDrained closes drained once a session being shut down has no streams
+// left in either direction. It must be called with chLock held.
+func (mp *Multiplex) checkDrained() {
+	if mp.drained != nil && len(mp.channels) == 0 && len(mp.writers) == 0 && !isClosedChan(mp.drained) {
+		close(mp.drained)
+	}
+}
+
+// GetStream returns the open stream with the given id, if any. Stream ids are
+// only unique per direction: initiator selects streams opened by us rather
+// than by the peer.
+func (mp *Multiplex) GetStream(id uint64, initiator bool) (*Stream, bool) {
+	mp.chLock.RLock()
+	defer mp.chLock.RUnlock()
+	s, ok := mp.channels[streamID{id: id, initiator: initiator}]
+	return s, ok
+}
+
+// NumStreams returns the number of open streams.
+func (mp *Multiplex) NumStreams() int {
+	mp.chLock.RLock()
+	defer mp.chLock.RUnlock()
+	return len(mp.channels)
+}
+
+// StreamIDs returns the ids of the open streams. Streams opened by us and by
+// the peer may share an id, so the same id can appear twice.
+func (mp *Multiplex) StreamIDs() []uint64 {
+	mp.chLock.RLock()
+	defer mp.chLock.RUnlock()
+	ids := make([]uint64, 0, len(mp.channels))
+	for id := range mp.channels {
+		ids = append(ids, id.id)
+	}
+	return ids
+}
+
+// CloseStreams closes all open streams for which filter returns true, leaving
+// the session and any other streams open.
+func (mp *Multiplex) CloseStreams(filter func(*Stream) bool) error {
+	// Closing a stream unregisters it, so don't hold the lock while doing
+	// so. This also means filter may safely call methods on the session.
+	mp.chLock.RLock()
+	streams := make([]*Stream, 0, len(mp.channels))
+	for _, s := range mp.channels {
+		streams = append(streams, s)
+	}
+	mp.chLock.RUnlock()
+
+	var err error
+	for _, s := range streams {
+		if filter(s) {
+			err = multierr.Append(err, s.Close())
+		}
+	}
+	return err
+}
+
 func (mp *Multiplex) cleanup() {
+	// Check whether we're shutting down on purpose before shutting down.
+	// Closing the connection happens under the lock, so if we closed it,
+	// we'll know.
+	mp.shutdownLock.Lock()
+	closedLocally := isClosedChan(mp.shutdown)
+	closeErr := mp.closeErr
+	mp.shutdownLock.Unlock()
+
 	mp.closeNoWait()
 
 	// Take the channels.
 	mp.chLock.Lock()
 	channels := mp.channels
 	mp.channels = nil
+	mp.writers = nil
 	mp.chLock.Unlock()
 
+	// If we shut down the connection, whatever the read loop saw
+	// afterwards doesn't matter.
+	switch {
+	case closeErr != nil:
+		mp.shutdownErr = closeErr
+	case closedLocally || mp.shutdownErr == nil:
+		mp.shutdownErr = ErrShutdown
+	}
+
+	// Let streams know why, unless we're shutting down normally.
+	streamErr := ErrStreamReset
+	if mp.shutdownErr != ErrShutdown && mp.shutdownErr != io.EOF {
+		streamErr = mp.shutdownErr
+	}
+
 	// Cancel any reads/writes
 	for _, msch := range channels {
-		msch.cancelRead(ErrStreamReset)
-		msch.cancelWrite(ErrStreamReset)
+		msch.cancelRead(streamErr)
+		msch.cancelWrite(streamErr)
+		atomic.AddUint64(&mp.stats.streamsClosed, 1)
+		mp.metrics.StreamClosed(msch.id.id)
 	}
 
 	// And... shutdown!
-	if mp.shutdownErr == nil {
-		mp.shutdownErr = ErrShutdown
-	}
+	mp.log.Debugf("session shut down: %s", mp.shutdownErr)
+	mp.metrics.SessionClosed(mp.shutdownErr)
 	close(mp.closed)
 }
 
 func (mp *Multiplex) handleIncoming() {
+	defer mp.cleanup()
+
+	// Runs before cleanup, so the panic becomes the session error.
 	defer func() {
 		if rerr := recover(); rerr != nil {
 			fmt.Fprintf(os.Stderr, "caught panic in handleIncoming: %s\n%s\n", rerr, debug.Stack())
+			mp.shutdownErr = fmt.Errorf("caught panic in handleIncoming: %v", rerr)
 		}
 	}()
 
-	defer mp.cleanup()
-
 	recvTimeout := time.NewTimer(0)
 	defer recvTimeout.Stop()
 	recvTimeoutFired := false
@@ -380,6 +1371,9 @@ loop:
 			mp.shutdownErr = err
 			return
 		}
+		atomic.AddUint64(&mp.stats.framesReceived, 1)
+
+		isPing := tag == pingTag && chID == pingStreamID
 
 		remoteIsInitiator := tag&1 == 0
 		ch := streamID{
@@ -387,13 +1381,6 @@ loop:
 			initiator: !remoteIsInitiator,
 			id:        chID,
 		}
-		// Rounds up the tag:
-		// 0 -> 0
-		// 1 -> 2
-		// 2 -> 2
-		// 3 -> 4
-		// etc...
-		tag += (tag & 1)
 
 		mlen, err := mp.readNextMsgLen()
 		if err != nil {
@@ -401,55 +1388,128 @@ loop:
 			return
 		}
 
-		mp.chLock.Lock()
+		if isPing {
+			if err := mp.handlePing(mlen); err != nil {
+				mp.shutdownErr = err
+				return
+			}
+			continue
+		}
+
+		// The stream may be unregistered (by canceling reads) as soon as
+		// we let go of the lock. That's fine: deliveries below give up
+		// once reads are canceled, so we never deliver into a stream
+		// nobody will read from.
+		mp.chLock.RLock()
 		msch, ok := mp.channels[ch]
-		mp.chLock.Unlock()
+		mp.chLock.RUnlock()
 
 		switch tag {
-		case newStreamTag:
+		case NewStreamTag:
 			if ok {
-				log.Debugf("received NewStream message for existing stream: %d", ch)
+				mp.log.Debugf("received NewStream message for existing stream: %d", ch.id)
 				mp.shutdownErr = ErrInvalidState
 				return
 			}
 
-			// skip stream name, this is not at all useful in the context of libp2p streams
-			if err := mp.skipNextMsg(mlen); err != nil {
-				mp.shutdownErr = err
-				return
+			if mp.maxNameLength > 0 && mlen > mp.maxNameLength {
+				if err := mp.skipNextMsg(mlen); err != nil {
+					mp.shutdownErr = err
+					return
+				}
+				mp.log.Debugf("stream name too long (%d bytes), resetting stream: %d", mlen, ch.id)
+				mp.rejectStream(ch)
+				continue
 			}
 
-			if mp.numStreams+1 > mp.maxStreams {
-				log.Debugf("accepting stream would exceed maxStreams: %d", ch)
-				continue
+			// Skip the stream name unless there's a filter to check it
+			// against, it's not at all useful in the context of libp2p
+			// streams.
+			var name string
+			if mp.acceptFilter == nil {
+				if err := mp.skipNextMsg(mlen); err != nil {
+					mp.shutdownErr = err
+					return
+				}
+			} else {
+				if mp.maxNameLength == 0 && mlen > BufferSize {
+					if err := mp.skipNextMsg(mlen); err != nil {
+						mp.shutdownErr = err
+						return
+					}
+					mp.log.Debugf("stream name too long to filter (%d bytes), resetting stream: %d", mlen, ch.id)
+					mp.rejectStream(ch)
+					continue
+				}
+
+				buf := pool.Get(mlen)
+				_, err := io.ReadFull(mp.body(), buf)
+				name = string(buf)
+				pool.Put(buf)
+				if err != nil {
+					mp.shutdownErr = unexpectedEOF(err)
+					return
+				}
+				if !mp.acceptFilter(name) {
+					mp.log.Debugf("stream %q refused by filter, resetting stream: %d", name, ch.id)
+					mp.rejectStream(ch)
+					continue
+				}
 			}
 
-			msch = mp.newStream(ch, "")
 			mp.chLock.Lock()
-			mp.channels[ch] = msch
+			draining, full := mp.draining, mp.numStreams >= mp.maxStreams
+			if !draining && !full {
+				msch = mp.newStream(ch, name)
+				mp.channels[ch] = msch
+				mp.writers[ch] = msch
+				mp.numStreams++
+			}
 			mp.chLock.Unlock()
+			if draining {
+				mp.log.Debugf("session is shutting down, resetting stream: %d", ch.id)
+				mp.rejectStream(ch)
+				continue
+			}
+			if full {
+				mp.log.Debugf("accepting stream would exceed maxStreams, resetting stream: %d", ch.id)
+				mp.rejectStream(ch)
+				continue
+			}
+
 			select {
 			case mp.nstreams <- msch:
-				mp.numStreams = mp.numStreams + 1
+				atomic.AddUint64(&mp.stats.streamsOpened, 1)
+				mp.metrics.StreamOpened(ch.id)
+				mp.log.Debugf("stream opened by peer: %d", chID)
 			case <-mp.shutdown:
 				return
 			}
 
-		case resetTag:
+		case ResetReceiverTag, ResetInitiatorTag:
 			if err := mp.skipNextMsg(mlen); err != nil {
 				mp.shutdownErr = err
 				return
 			}
 
+			if !ok {
+				// The peer may have closed the stream before
+				// resetting it, we're still writing to it then.
+				mp.chLock.RLock()
+				msch, ok = mp.writers[ch]
+				mp.chLock.RUnlock()
+			}
 			if !ok {
 				// This is *ok*. We forget the stream on reset.
 				continue
 			}
 
+			mp.log.Debugf("stream reset by peer: %d", chID)
+
 			// Cancel any ongoing reads/writes.
 			msch.cancelRead(ErrStreamReset)
 			msch.cancelWrite(ErrStreamReset)
-		case closeTag:
+		case CloseReceiverTag, CloseInitiatorTag:
 			if err := mp.skipNextMsg(mlen); err != nil {
 				mp.shutdownErr = err
 				return
@@ -460,21 +1520,22 @@ loop:
 				continue
 			}
 
+			mp.log.Debugf("stream closed by peer: %d", chID)
+
 			// unregister and throw away future data.
-			mp.chLock.Lock()
-			delete(mp.channels, ch)
-			mp.chLock.Unlock()
+			mp.unregisterStream(ch)
 
 			// close data channel, there will be no more data.
 			close(msch.dataIn)
-			mp.numStreams = mp.numStreams - 1
 
 			// We intentionally don't cancel any deadlines, cancel reads, cancel
 			// writes, etc. We just deliver the EOF by closing the
 			// data channel, and unregister the channel so we don't
 			// receive any more data. The user still needs to call
 			// `Close()` or `Reset()`.
-		case messageTag:
+		case MessageReceiverTag, MessageInitiatorTag:
+			atomic.AddUint64(&mp.stats.bytesReceived, uint64(mlen))
+			mp.metrics.MessageReceived(chID, mlen)
 			if !ok {
 				// We're not accepting data on this stream, for
 				// some reason. It's likely that we reset it, or
@@ -485,6 +1546,7 @@ loop:
 				}
 				continue
 			}
+			msch.touch()
 
 		read:
 			for rd := 0; rd < mlen; {
@@ -504,11 +1566,16 @@ loop:
 				if !recvTimeout.Stop() && !recvTimeoutFired {
 					<-recvTimeout.C
 				}
-				recvTimeout.Reset(ReceiveTimeout)
+				recvTimeout.Reset(mp.receiveTimeout)
 				recvTimeoutFired = false
 
 				select {
-				case msch.dataIn <- b:
+				case msch.dataIn <- received{data: b, more: rd < mlen}:
+					// If reads were canceled while we were
+					// delivering, nobody will release this.
+					if isClosedChan(msch.readCancel) {
+						msch.releaseBuffers()
+					}
 
 				case <-msch.readCancel:
 					// the user has canceled reading. walk away.
@@ -522,7 +1589,7 @@ loop:
 				case <-recvTimeout.C:
 					recvTimeoutFired = true
 					mp.putBufferInbound(b)
-					log.Warnf("timed out receiving message into stream queue.")
+					mp.log.Warnf("timed out receiving message into stream queue.")
 					// Do not do this asynchronously. Otherwise, we
 					// could drop a message, then receive a message,
 					// then reset.
@@ -540,7 +1607,7 @@ loop:
 			}
 
 		default:
-			log.Debugf("message with unknown header on stream %s", ch)
+			mp.log.Debugf("message with unknown tag %s on stream %d", tag, ch.id)
 			mp.skipNextMsg(mlen)
 			if ok {
 				msch.Reset()
@@ -558,6 +1625,56 @@ func (mp *Multiplex) isShutdown() bool {
 	}
 }
 
+// maxPendingRejects is how many resets of refused streams may wait to be sent.
+const maxPendingRejects = 64
+
+// rejectStream resets a stream the peer opened without ever accepting it.
+//
+// The resets are sent one at a time from a bounded queue, so a peer opening
+// streams faster than it reads can't make us pile up goroutines. Once the
+// queue is full, the read loop waits for room, up to ResetStreamTimeout,
+// before giving up on the peer and closing the session.
+func (mp *Multiplex) rejectStream(id streamID) {
+	mp.metrics.StreamRejected(id.id)
+
+	select {
+	case mp.rejects <- id:
+	default:
+		timer := time.NewTimer(ResetStreamTimeout)
+		defer timer.Stop()
+
+		select {
+		case mp.rejects <- id:
+		case <-timer.C:
+			mp.log.Warnf("timed out queueing reset of refused stream %d; killing connection", id.id)
+			mp.closeWithError(ErrWriteTimeout)
+			return
+		case <-mp.shutdown:
+			return
+		}
+	}
+	if atomic.CompareAndSwapInt32(&mp.rejecting, 0, 1) {
+		mp.spawn(mp.sendRejects)
+	}
+}
+
+// sendRejects sends the queued resets of refused streams.
+func (mp *Multiplex) sendRejects() {
+	for {
+		select {
+		case id := <-mp.rejects:
+			mp.sendResetMsg(id.header(ResetInitiatorTag), false)
+		default:
+			atomic.StoreInt32(&mp.rejecting, 0)
+			// Carry on if a reset was queued after we looked, unless
+			// someone else already has.
+			if len(mp.rejects) == 0 || !atomic.CompareAndSwapInt32(&mp.rejecting, 0, 1) {
+				return
+			}
+		}
+	}
+}
+
 func (mp *Multiplex) sendResetMsg(header uint64, hard bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), ResetStreamTimeout)
 	defer cancel()
@@ -565,36 +1682,91 @@ func (mp *Multiplex) sendResetMsg(header uint64, hard bool) {
 	err := mp.sendMsg(ctx.Done(), nil, header, nil)
 	if err != nil && !mp.isShutdown() {
 		if hard {
-			log.Warnf("error sending reset message: %s; killing connection", err.Error())
+			mp.log.Warnf("error sending reset message: %s; killing connection", err.Error())
 			mp.Close()
 		} else {
-			log.Debugf("error sending reset message: %s", err.Error())
+			mp.log.Debugf("error sending reset message: %s", err.Error())
 		}
 	}
 }
 
-func (mp *Multiplex) readNextHeader() (uint64, uint64, error) {
-	h, err := varint.ReadUvarint(mp.buf)
-	if err != nil {
-		return 0, 0, err
+// timeoutReader shuts the session down when a read takes longer than the read
+// timeout.
+type timeoutReader struct {
+	r     io.Reader
+	mp    *Multiplex
+	timer *time.Timer
+}
+
+func (tr *timeoutReader) Read(b []byte) (int, error) {
+	// Only the read loop reads, so there are never two reads at once.
+	if tr.timer == nil {
+		tr.timer = time.AfterFunc(tr.mp.readTimeout, func() {
+			tr.mp.closeWithError(ErrReadTimeout)
+		})
+	} else {
+		tr.timer.Reset(tr.mp.readTimeout)
 	}
+	defer tr.timer.Stop()
+	return tr.r.Read(b)
+}
 
-	// get channel ID
-	ch := h >> 3
+// packetReader reads whole packets from a message-oriented connection, so none
+// get truncated, and hands them out as a stream of bytes.
+type packetReader struct {
+	r    io.Reader
+	buf  []byte
+	rest []byte
+	err  error
+}
 
-	rem := h & 7
+func (pr *packetReader) Read(b []byte) (int, error) {
+	if len(pr.rest) == 0 {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		n, err := pr.r.Read(pr.buf)
+		pr.rest, pr.err = pr.buf[:n], err
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, pr.rest)
+	pr.rest = pr.rest[n:]
+	return n, nil
+}
 
-	return ch, rem, nil
+func (mp *Multiplex) readNextHeader() (uint64, MessageTag, error) {
+	var h uint64
+	var err error
+	if mp.framer != nil {
+		var payload []byte
+		h, payload, err = mp.framer.ReadFrame(mp.buf, mp.maxMessageSize)
+		mp.frame.Reset(payload)
+	} else {
+		h, err = varint.ReadUvarint(mp.buf)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ch, tag := DecodeHeader(h)
+	return ch, tag, nil
 }
 
 func (mp *Multiplex) readNextMsgLen() (int, error) {
+	if mp.framer != nil {
+		// ReadFrame already checked the size.
+		return mp.frame.Len(), nil
+	}
+
 	l, err := varint.ReadUvarint(mp.buf)
 	if err != nil {
-		return 0, err
+		return 0, unexpectedEOF(err)
 	}
 
-	if l > uint64(MaxMessageSize) {
-		return 0, fmt.Errorf("message size too large")
+	if l > uint64(mp.maxMessageSize) {
+		return 0, fmt.Errorf("message size too large: %d > %d", l, mp.maxMessageSize)
 	}
 
 	if l == 0 {
@@ -610,10 +1782,10 @@ func (mp *Multiplex) readNextChunk(mlen int) ([]byte, error) {
 		return nil, err
 	}
 
-	_, err = io.ReadFull(mp.buf, buf)
+	_, err = io.ReadFull(mp.body(), buf)
 	if err != nil {
 		mp.putBufferInbound(buf)
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
 
 	return buf, nil
@@ -624,7 +1796,28 @@ func (mp *Multiplex) skipNextMsg(mlen int) error {
 		return nil
 	}
 
+	if mp.framer != nil {
+		_, err := mp.frame.Seek(int64(mlen), io.SeekCurrent)
+		return err
+	}
 	_, err := mp.buf.Discard(mlen)
+	return unexpectedEOF(err)
+}
+
+// body returns what to read the payload of the current message from.
+func (mp *Multiplex) body() io.Reader {
+	if mp.framer != nil {
+		return &mp.frame
+	}
+	return mp.buf
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF. Use it when reading
+// the rest of a frame, where the connection must not end.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
 	return err
 }
 
@@ -649,13 +1842,15 @@ func (mp *Multiplex) getBufferInbound(length int) ([]byte, error) {
 	return mp.getBuffer(length), nil
 }
 
-func (mp *Multiplex) getBufferOutbound(length int, timeout, cancel <-chan struct{}) ([]byte, error) {
+func (mp *Multiplex) getBufferOutbound(length int, timeout, cancel, done <-chan struct{}) ([]byte, error) {
 	select {
 	case mp.bufOut <- struct{}{}:
 	case <-timeout:
 		return nil, errTimeout
 	case <-cancel:
 		return nil, ErrStreamClosed
+	case <-done:
+		return nil, errCanceled
 	case <-mp.shutdown:
 		return nil, ErrShutdown
 	}
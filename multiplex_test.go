@@ -1,15 +1,23 @@
 package multiplex
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"os"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/multiformats/go-varint"
 )
 
 func TestSlowReader(t *testing.T) {
@@ -162,6 +170,173 @@ func TestOpenStreamDeadline(t *testing.T) {
 	if !deadlineExceeded {
 		t.Fatal("expected a deadline error to occur at some point")
 	}
+
+	mp.chLock.Lock()
+	nchannels := len(mp.channels)
+	mp.chLock.Unlock()
+	if nchannels != counter {
+		t.Fatalf("expected %d registered streams, got %d", counter, nchannels)
+	}
+}
+
+func TestStreamIDsExhausted(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	mpa.nextID = maxStreamID - 1
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.ID() != s.ID() {
+		t.Fatalf("expected stream id %d, got %d", s.ID(), sb.ID())
+	}
+
+	if _, err := mpa.NewStream(context.Background()); err != ErrStreamIDsExhausted {
+		t.Fatalf("expected ErrStreamIDsExhausted, got %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	// pings don't get in the way of streams
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		if _, err := mpa.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mpb.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := sa.Write([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if mpa.NumStreams() != 1 || mpb.NumStreams() != 1 {
+		t.Fatal("pings opened streams")
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	a, b := net.Pipe()
+
+	mp, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	// a peer that reads everything but never answers
+	go io.Copy(io.Discard, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := mp.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	a, b := net.Pipe()
+
+	mp, err := NewMultiplex(a, false, nil, 256, WithKeepAlive(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	go io.Copy(io.Discard, b)
+
+	select {
+	case <-mp.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to shut down")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256, WithReadTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+
+	// Pings keep the session alive.
+	mpb, err := NewMultiplex(b, true, nil, 256, WithKeepAlive(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if mpa.IsClosed() {
+		t.Fatalf("expected the session to stay open, got %v", mpa.Err())
+	}
+
+	mpb.Close()
+
+	// A silent peer times out.
+	c, d := net.Pipe()
+	defer d.Close()
+	mpc, err := NewMultiplex(c, false, nil, 256, WithReadTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpc.Close()
+	select {
+	case <-mpc.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to time out")
+	}
+	if err := mpc.Err(); err != ErrReadTimeout {
+		t.Fatalf("expected %v, got %v", ErrReadTimeout, err)
+	}
 }
 
 func TestWriteAfterClose(t *testing.T) {
@@ -571,6 +746,146 @@ func TestReset(t *testing.T) {
 	}
 }
 
+func TestResetDiscardsBufferedData(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sb.Write([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	sb.Reset()
+
+	time.Sleep(200 * time.Millisecond)
+
+	n, err := sa.Read(make([]byte, 10))
+	if n != 0 || err != ErrStreamReset {
+		t.Fatalf("expected a reset error, got %d, %v", n, err)
+	}
+	if len(mpa.bufIn) != 0 {
+		t.Fatalf("expected buffered data to be discarded, %d buffers in use", len(mpa.bufIn))
+	}
+}
+
+func TestCloseReadReleasesBuffers(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sb.Write([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.Write([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// leave part of the first message buffered, and the second queued
+	if _, err := sa.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(mpa.bufIn) == 0 {
+		t.Fatal("expected buffers to be in use")
+	}
+
+	sa.CloseRead()
+	if len(mpa.bufIn) != 0 {
+		t.Fatalf("expected buffers to be released, %d buffers in use", len(mpa.bufIn))
+	}
+}
+
+func TestCloseReadDuringDelivery(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	for i := 0; i < 10; i++ {
+		sa, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := mpb.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if _, err := sb.Write([]byte("test")); err != nil {
+					return
+				}
+			}
+		}()
+
+		if _, err := sa.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		sa.CloseRead()
+		sb.Reset()
+		<-done
+	}
+
+	// wait for anything in flight to be delivered or dropped
+	time.Sleep(100 * time.Millisecond)
+
+	if n := len(mpa.bufIn); n != 0 {
+		t.Fatalf("leaked %d buffers delivered to closed streams", n)
+	}
+}
+
 func TestCancelRead(t *testing.T) {
 	a, b := net.Pipe()
 
@@ -885,7 +1200,7 @@ func TestDeadline(t *testing.T) {
 	}
 }
 
-func TestReadAfterClose(t *testing.T) {
+func TestPastDeadline(t *testing.T) {
 	a, b := net.Pipe()
 
 	mpa, err := NewMultiplex(a, false, nil, 256)
@@ -910,24 +1225,34 @@ func TestReadAfterClose(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	sa.Close()
+	if _, err := sb.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the data is buffered on sa before setting the deadline
+	buf := make([]byte, 1)
+	if _, err := sa.Read(buf); err != nil {
+		t.Fatal(err)
+	}
 
-	_, err = sb.Read(make([]byte, 1024))
-	if err != io.EOF {
-		t.Fatal("expected EOF")
+	sa.SetDeadline(time.Now().Add(-time.Second))
+
+	if _, err := sa.Read(buf); err != errTimeout {
+		t.Fatalf("expected timeout on read, got %v", err)
+	}
+	if _, err := sa.Write([]byte("bar")); err != errTimeout {
+		t.Fatalf("expected timeout on write, got %v", err)
 	}
-}
 
-func TestFuzzCloseStream(t *testing.T) {
-	timer := time.AfterFunc(10*time.Second, func() {
-		// This is really the *only* reliable way to set a timeout on
-		// this test...
-		// Don't add *anything* to this function. The go scheduler acts
-		// a bit funny when it encounters a deadlock...
-		panic("timeout")
-	})
-	defer timer.Stop()
+	// clearing the deadline makes the stream usable again
+	sa.SetDeadline(time.Time{})
+
+	n, err := sa.Read(make([]byte, 2))
+	if err != nil || n != 2 {
+		t.Fatalf("expected to read the buffered data, got %d, %v", n, err)
+	}
+}
 
+func TestReadAfterClose(t *testing.T) {
 	a, b := net.Pipe()
 
 	mpa, err := NewMultiplex(a, false, nil, 256)
@@ -943,10 +1268,101 @@ func TestFuzzCloseStream(t *testing.T) {
 	defer mpa.Close()
 	defer mpb.Close()
 
-	done := make(chan struct{})
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	go func() {
-		streams := make([]*Stream, 100)
+	sa.Close()
+
+	_, err = sb.Read(make([]byte, 1024))
+	if err != io.EOF {
+		t.Fatal("expected EOF")
+	}
+}
+
+func TestReadBufferedAfterClose(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read part of the first message so the rest is left buffered
+	go func() {
+		sa.Write([]byte("hello"))
+		sa.Write([]byte(" world"))
+		sa.Close()
+	}()
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the close to arrive
+	time.Sleep(100 * time.Millisecond)
+
+	rest, err := io.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf)+string(rest) != "hello world" {
+		t.Fatalf("got bad data: %q", string(buf)+string(rest))
+	}
+}
+
+func TestFuzzCloseStream(t *testing.T) {
+	timer := time.AfterFunc(10*time.Second, func() {
+		// This is really the *only* reliable way to set a timeout on
+		// this test...
+		// Don't add *anything* to this function. The go scheduler acts
+		// a bit funny when it encounters a deadlock...
+		panic("timeout")
+	})
+	defer timer.Stop()
+
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		streams := make([]*Stream, 100)
 		for i := range streams {
 			var err error
 			streams[i], err = mpb.NewStream(context.Background())
@@ -1005,19 +1421,32 @@ func TestFuzzCloseStream(t *testing.T) {
 	}
 }
 
-func TestLargeWrite(t *testing.T) {
-	oldChunkSize := ChunkSize
-	ChunkSize = 16384
-	t.Cleanup(func() {
-		ChunkSize = oldChunkSize
-	})
+type failingWriteConn struct {
+	net.Conn
 
+	fail chan struct{}
+}
+
+var errFailingWrite = errors.New("write failed")
+
+func (c *failingWriteConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.fail:
+		return 0, errFailingWrite
+	default:
+		return c.Conn.Write(b)
+	}
+}
+
+func TestWriteErrorShutdown(t *testing.T) {
 	a, b := net.Pipe()
 
-	mpa, err := NewMultiplex(a, false, nil, 256)
+	fa := &failingWriteConn{Conn: a, fail: make(chan struct{})}
+	mpa, err := NewMultiplex(fa, false, nil, 256)
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	mpb, err := NewMultiplex(b, true, nil, 256)
 	if err != nil {
 		t.Fatal(err)
@@ -1026,70 +1455,3648 @@ func TestLargeWrite(t *testing.T) {
 	defer mpa.Close()
 	defer mpb.Close()
 
-	const msgsize = 65536
-	msg := make([]byte, msgsize)
-	if _, err := rand.Read(msg); err != nil {
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpb.Accept(); err != nil {
 		t.Fatal(err)
 	}
 
-	res1 := make(chan error, 1)
-	res2 := make(chan error, 1)
-	go func() {
-		s, err := mpa.NewStream(context.Background())
-		if err != nil {
-			res1 <- err
-			return
-		}
-		defer s.Close()
+	close(fa.fail)
+	// this write is queued, but fails on the wire
+	if _, err := sa.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
 
-		_, err = s.Write(msg)
-		res1 <- err
-	}()
+	select {
+	case <-mpa.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not shut down after a write error")
+	}
 
-	go func() {
-		s, err := mpb.Accept()
-		if err != nil {
-			res2 <- err
-			return
-		}
+	if _, err := sa.Write([]byte("bar")); err != errFailingWrite {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	if _, err := mpa.Accept(); err != errFailingWrite {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+}
 
-		defer s.Close()
+func TestWriteTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
 
-		buf := make([]byte, msgsize)
-		_, err = io.ReadFull(s, buf)
-		if err != nil {
-			res2 <- err
-			return
-		}
+	mp, err := NewMultiplex(a, false, nil, 256, WithWriteTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
 
-		res2 <- arrComp(buf, msg)
-	}()
+	// Nobody reads from b, so writes never complete.
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteSync([]byte("foo")); err != ErrWriteTimeout {
+		t.Fatalf("expected %v, got %v", ErrWriteTimeout, err)
+	}
+	<-mp.CloseChan()
+	if err := mp.Err(); err != ErrWriteTimeout {
+		t.Fatalf("expected %v, got %v", ErrWriteTimeout, err)
+	}
+}
 
-	err = <-res1
+func TestWriteErrorHandler(t *testing.T) {
+	a, b := net.Pipe()
+
+	var calls int32
+	var handled error
+	handler := func(err error) {
+		atomic.AddInt32(&calls, 1)
+		handled = err
+	}
+
+	fa := &failingWriteConn{Conn: a, fail: make(chan struct{})}
+	mpa, err := NewMultiplex(fa, false, nil, 256, WithWriteErrorHandler(handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = <-res2
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
+	if _, err := mpb.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	close(fa.fail)
+	if _, err := sa.WriteSync([]byte("foo")); err != errFailingWrite {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	<-mpa.CloseChan()
+	sa.Write([]byte("bar"))
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected the handler to be called once, got %d calls", n)
+	}
+	if handled != errFailingWrite {
+		t.Fatalf("expected the handler to get the write error, got %v", handled)
+	}
 }
 
-func arrComp(a, b []byte) error {
-	msg := ""
-	if len(a) != len(b) {
-		msg += fmt.Sprintf("arrays differ in length: %d %d\n", len(a), len(b))
+func TestWriteSync(t *testing.T) {
+	a, b := net.Pipe()
+
+	fa := &failingWriteConn{Conn: a, fail: make(chan struct{})}
+	mpa, err := NewMultiplex(fa, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for i := 0; i < len(a) && i < len(b); i++ {
-		if a[i] != b[i] {
-			msg += fmt.Sprintf("content differs at index %d [%d != %d]", i, a[i], b[i])
-			return fmt.Errorf(msg)
-		}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(msg) > 0 {
-		return fmt.Errorf(msg)
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mes := []byte("Hello world")
+	n, err := sa.WriteSync(mes)
+	if err != nil || n != len(mes) {
+		t.Fatalf("expected a successful write, got %d, %v", n, err)
+	}
+
+	buf := make([]byte, len(mes))
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := arrComp(buf, mes); err != nil {
+		t.Fatal(err)
+	}
+
+	close(fa.fail)
+	n, err = sa.WriteSync(mes)
+	if err != errFailingWrite || n != 0 {
+		t.Fatalf("expected the write error, got %d, %v", n, err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	a, b := net.Pipe()
+
+	mp, err := NewMultiplex(a, false, nil, 256, WithMaxMessageSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	defer b.Close()
+
+	// a new stream message with an 11 byte name
+	go b.Write(append([]byte{0, 11}, "hello world"...))
+
+	select {
+	case <-mp.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to shut down")
+	}
+
+	if _, err := mp.Accept(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSessionErr(t *testing.T) {
+	a, b := net.Pipe()
+
+	mp, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	if err := mp.Err(); err != nil {
+		t.Fatalf("expected no error on an open session, got %v", err)
+	}
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read the new stream message, then send garbage
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	go b.Write([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80})
+
+	select {
+	case <-mp.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to shut down")
+	}
+
+	if mp.Err() == nil || mp.Err() == ErrShutdown || mp.Err() == io.EOF {
+		t.Fatalf("expected a decoding error, got %v", mp.Err())
+	}
+	if _, err := s.Read(make([]byte, 1)); err != mp.Err() {
+		t.Fatalf("expected reads to fail with %v, got %v", mp.Err(), err)
+	}
+}
+
+func TestSessionErrClose(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpb.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	mpa.Close()
+	if err := mpa.Err(); err != ErrShutdown {
+		t.Fatalf("expected ErrShutdown, got %v", err)
+	}
+	if _, err := sa.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected ErrStreamReset, got %v", err)
+	}
+
+	<-mpb.CloseChan()
+	if err := mpb.Err(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestDuplicateNewStream(t *testing.T) {
+	a, b := net.Pipe()
+
+	mp, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	defer b.Close()
+
+	// open stream 0 twice
+	newStream := []byte{0, 1, '0'}
+	go b.Write(newStream)
+	if _, err := mp.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	go b.Write(newStream)
+	<-mp.CloseChan()
+	if _, err := mp.Accept(); err != ErrInvalidState {
+		t.Fatalf("expected ErrInvalidState, got %v", err)
+	}
+}
+
+func TestMaxStreamNameLength(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256, WithMaxStreamNameLength(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256, WithMaxStreamNameLength(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	if _, err := mpa.NewNamedStream(context.Background(), "too long!"); err != ErrNameTooLong {
+		t.Fatalf("expected ErrNameTooLong, got %v", err)
+	}
+
+	// mpb rejects this one
+	sa, err := mpa.NewNamedStream(context.Background(), "longer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sa.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected the stream to be reset, got %v", err)
+	}
+
+	if _, err := mpa.NewNamedStream(context.Background(), "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpb.Accept(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"clean", nil, io.EOF},
+		{"partial header", []byte{0x80}, io.ErrUnexpectedEOF},
+		{"missing length", []byte{0}, io.ErrUnexpectedEOF},
+		{"partial body", []byte{0, 5, 'a'}, io.ErrUnexpectedEOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := net.Pipe()
+
+			mp, err := NewMultiplex(a, false, nil, 256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp.Close()
+
+			go func() {
+				b.Write(tc.data)
+				b.Close()
+			}()
+
+			if _, err := mp.Accept(); err != tc.err {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestNonMinimalVarint(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"header", []byte{0x80, 0x00, 0}},
+		{"length", []byte{0, 0x81, 0x00, 'a'}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := net.Pipe()
+
+			mp, err := NewMultiplex(a, false, nil, 256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp.Close()
+
+			go func() {
+				b.Write(tc.data)
+				b.Close()
+			}()
+
+			if _, err := mp.Accept(); err != varint.ErrNotMinimal {
+				t.Fatalf("expected %v, got %v", varint.ErrNotMinimal, err)
+			}
+		})
+	}
+}
+
+func TestGetStream(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sa.ID() != sb.ID() {
+		t.Fatalf("expected both ends to have the same id, got %d and %d", sa.ID(), sb.ID())
+	}
+
+	if s, ok := mpa.GetStream(sa.ID(), true); !ok || s != sa {
+		t.Fatal("expected to find the outbound stream")
+	}
+	if s, ok := mpb.GetStream(sb.ID(), false); !ok || s != sb {
+		t.Fatal("expected to find the inbound stream")
+	}
+	if _, ok := mpa.GetStream(sa.ID(), false); ok {
+		t.Fatal("found a stream opened by the peer")
+	}
+
+	sa.Reset()
+	if _, ok := mpa.GetStream(sa.ID(), true); ok {
+		t.Fatal("found a reset stream")
+	}
+}
+
+func TestCloseGraceful(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 3*ChunkSize)
+	rand.Read(msg)
+
+	res := make(chan error, 1)
+	go func() {
+		buf, err := io.ReadAll(sb)
+		if err != nil {
+			res <- err
+			return
+		}
+		res <- arrComp(buf, msg)
+	}()
+
+	if _, err := sa.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mpa.CloseGraceful(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !mpa.IsClosed() {
+		t.Fatal("expected the session to be closed")
+	}
+
+	if err := <-res; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testMetrics struct {
+	mu                   sync.Mutex
+	opened, closed       int
+	sent, received       int
+	messagesReceived     int
+	rejected             int
+	sessionClosed        bool
+	sessionClosedWithErr error
+}
+
+func (m *testMetrics) StreamOpened(stream uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opened++
+}
+
+func (m *testMetrics) StreamClosed(stream uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed++
+}
+
+func (m *testMetrics) MessageSent(stream uint64, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent += size
+}
+
+func (m *testMetrics) MessageReceived(stream uint64, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received += size
+	m.messagesReceived++
+}
+
+func (m *testMetrics) StreamRejected(stream uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected++
+}
+
+func (m *testMetrics) SessionClosed(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionClosed = true
+	m.sessionClosedWithErr = err
+}
+
+func TestMetrics(t *testing.T) {
+	a, b := net.Pipe()
+
+	var ma, mb testMetrics
+	mpa, err := NewMultiplex(a, false, nil, 256, WithMetrics(&ma))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256, WithMetrics(&mb))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sa.WriteSync([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	sa.Reset()
+
+	mpa.Close()
+	mpb.Close()
+
+	for _, m := range []*testMetrics{&ma, &mb} {
+		m.mu.Lock()
+		if m.opened != 1 || m.closed != 1 {
+			t.Errorf("expected 1 stream to be opened and closed, got %d and %d", m.opened, m.closed)
+		}
+		if !m.sessionClosed {
+			t.Error("expected the session to be reported closed")
+		}
+		m.mu.Unlock()
+	}
+	if ma.sent != 5 {
+		t.Errorf("expected 5 bytes sent, got %d", ma.sent)
+	}
+	if mb.received != 5 {
+		t.Errorf("expected 5 bytes received, got %d", mb.received)
+	}
+	if ma.sessionClosedWithErr != ErrShutdown {
+		t.Errorf("expected ErrShutdown, got %v", ma.sessionClosedWithErr)
+	}
+}
+
+func TestWriteBuffers(t *testing.T) {
+	a, b := net.Pipe()
+
+	var metrics testMetrics
+	mpa, err := NewMultiplex(a, false, nil, 256, WithChunkSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256, WithMetrics(&metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		n, err := sa.WriteBuffers(net.Buffers{[]byte("he"), []byte("llo wor"), nil, []byte("ld")})
+		if err != nil || n != 11 {
+			t.Errorf("expected to write 11 bytes, wrote %d: %v", n, err)
+		}
+		sa.Close()
+	}()
+
+	buf, err := io.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello world" {
+		t.Fatalf("expected %q, got %q", "hello world", buf)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.messagesReceived != 2 {
+		t.Fatalf("expected 2 messages, got %d", metrics.messagesReceived)
+	}
+}
+
+func TestZeroLengthWrite(t *testing.T) {
+	a, b := net.Pipe()
+
+	var metrics testMetrics
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256, WithMetrics(&metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer sa.Close()
+		for _, write := range []func([]byte) (int, error){sa.Write, sa.WriteSync} {
+			for _, b := range [][]byte{nil, {}} {
+				if n, err := write(b); n != 0 || err != nil {
+					t.Errorf("expected an empty write to succeed, got %d, %v", n, err)
+				}
+			}
+		}
+		if n, err := sa.WriteBuffers(net.Buffers{nil, {}}); n != 0 || err != nil {
+			t.Errorf("expected an empty write to succeed, got %d, %v", n, err)
+		}
+		if _, err := sa.Write([]byte("x")); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf, err := io.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "x" {
+		t.Fatalf("expected %q, got %q", "x", buf)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.messagesReceived != 1 {
+		t.Fatalf("expected empty writes not to send any messages, got %d messages", metrics.messagesReceived)
+	}
+}
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Warnf(format string, args ...interface{}) {
+	l.Debugf(format, args...)
+}
+
+func TestLogger(t *testing.T) {
+	a, b := net.Pipe()
+
+	var logger testLogger
+	mpa, err := NewMultiplex(a, false, nil, 256, WithLogger(&logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if _, err := mpa.NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpb.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	mpa.Close()
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.logs) == 0 {
+		t.Fatal("expected the session to log to the logger")
+	}
+	if last := logger.logs[len(logger.logs)-1]; last != "session shut down: "+ErrShutdown.Error() {
+		t.Fatalf("unexpected log message: %s", last)
+	}
+}
+
+func TestCloseStreams(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	for _, name := range []string{"foo/1", "bar/1", "foo/2"} {
+		if _, err := mpa.NewNamedStream(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mpb.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = mpa.CloseStreams(func(s *Stream) bool {
+		return strings.HasPrefix(s.Name(), "foo/")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := mpa.NumStreams(); n != 1 {
+		t.Fatalf("expected 1 stream left, got %d", n)
+	}
+	if mpa.IsClosed() {
+		t.Fatal("closing streams closed the session")
+	}
+}
+
+func TestStreamAddr(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, ok := sa.LocalAddr().(*Addr)
+	if !ok {
+		t.Fatalf("unexpected address type %T", sa.LocalAddr())
+	}
+	if addr.Stream != sa.ID() || addr.Conn != a.LocalAddr() {
+		t.Fatalf("unexpected local address %s", addr)
+	}
+	if addr := sa.RemoteAddr().(*Addr); addr.Conn != a.RemoteAddr() {
+		t.Fatalf("unexpected remote address %s", addr)
+	}
+	if sa.LocalAddr().Network() != "mplex" {
+		t.Fatalf("unexpected network %s", sa.LocalAddr().Network())
+	}
+}
+
+func TestSessionAddr(t *testing.T) {
+	a, b := net.Pipe()
+
+	mp, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	defer b.Close()
+
+	if mp.LocalAddr() != a.LocalAddr() || mp.RemoteAddr() != a.RemoteAddr() {
+		t.Fatalf("unexpected addresses %s and %s", mp.LocalAddr(), mp.RemoteAddr())
+	}
+
+	// Not a net.Conn.
+	r, w := io.Pipe()
+	defer w.Close()
+	mpr, err := NewMultiplex(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{r, io.Discard, r}, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpr.Close()
+
+	if n := mpr.RemoteAddr().Network(); n != "unknown" {
+		t.Fatalf("expected a placeholder address, got network %s", n)
+	}
+	s, err := mpr.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := s.RemoteAddr().(*Addr); addr.Conn != nil {
+		t.Fatalf("expected streams to have no connection address, got %s", addr.Conn)
+	}
+}
+
+func TestNumStreams(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	streams := make([]*Stream, 3)
+	for i := range streams {
+		streams[i], err = mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := mpa.NumStreams(); n != len(streams) {
+		t.Fatalf("expected %d streams, got %d", len(streams), n)
+	}
+	ids := mpa.StreamIDs()
+	if len(ids) != len(streams) {
+		t.Fatalf("expected %d stream ids, got %d", len(streams), len(ids))
+	}
+
+	streams[0].Reset()
+	if n := mpa.NumStreams(); n != len(streams)-1 {
+		t.Fatalf("expected %d streams, got %d", len(streams)-1, n)
+	}
+
+	mpa.Close()
+	if n := mpa.NumStreams(); n != 0 {
+		t.Fatalf("expected no streams after close, got %d", n)
+	}
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	for _, size := range []int{0, 16, BufferSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			a, b := net.Pipe()
+
+			mpa, err := NewMultiplex(a, false, nil, 256, WithWriteBufferSize(size))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mpb, err := NewMultiplex(b, true, nil, 256)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer mpa.Close()
+			defer mpb.Close()
+
+			mes := make([]byte, 3*ChunkSize)
+			rand.Read(mes)
+
+			go func() {
+				s, err := mpa.NewStream(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := s.Write(mes); err != nil {
+					t.Error(err)
+				}
+				s.Close()
+			}()
+
+			s, err := mpb.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := arrComp(buf, mes); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	for _, size := range []int{16, BufferSize, 4 * BufferSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			mpa, mpb, err := NewPipePair(256, WithReadBufferSize(size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mpa.Close()
+			defer mpb.Close()
+
+			if n := mpb.buf.Size(); n != size {
+				t.Fatalf("expected a %d byte read buffer, got %d", size, n)
+			}
+
+			mes := make([]byte, 3*ChunkSize)
+			rand.Read(mes)
+
+			go func() {
+				s, err := mpa.NewStream(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := s.Write(mes); err != nil {
+					t.Error(err)
+				}
+				s.Close()
+			}()
+
+			s, err := mpb.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := arrComp(buf, mes); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLargeWrite(t *testing.T) {
+	oldChunkSize := ChunkSize
+	ChunkSize = 16384
+	t.Cleanup(func() {
+		ChunkSize = oldChunkSize
+	})
+
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	const msgsize = 65536
+	msg := make([]byte, msgsize)
+	if _, err := rand.Read(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	res1 := make(chan error, 1)
+	res2 := make(chan error, 1)
+	go func() {
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			res1 <- err
+			return
+		}
+		defer s.Close()
+
+		_, err = s.Write(msg)
+		res1 <- err
+	}()
+
+	go func() {
+		s, err := mpb.Accept()
+		if err != nil {
+			res2 <- err
+			return
+		}
+
+		defer s.Close()
+
+		buf := make([]byte, msgsize)
+		_, err = io.ReadFull(s, buf)
+		if err != nil {
+			res2 <- err
+			return
+		}
+
+		res2 <- arrComp(buf, msg)
+	}()
+
+	err = <-res1
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-res2
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	go func() {
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+
+		// spread the prefix over several messages
+		for _, m := range []string{"he", "llo", " world"} {
+			if _, err := s.Write([]byte(m)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	s, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := s.Peek(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "hello" {
+		t.Fatalf("expected to peek %q, got %q", "hello", p)
+	}
+
+	buf, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello world" {
+		t.Fatalf("expected to read %q, got %q", "hello world", buf)
+	}
+
+	if p, err := s.Peek(1); err != io.EOF || len(p) != 0 {
+		t.Fatalf("expected EOF, got %q, %v", p, err)
+	}
+}
+
+func TestPeekTooMuch(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	msg := make([]byte, 3*BufferSize)
+	rand.Read(msg)
+
+	go func() {
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+
+		if _, err := s.Write(msg); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	s, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := s.Peek(2 * BufferSize)
+	if err != bufio.ErrBufferFull {
+		t.Fatalf("expected %v, got %v", bufio.ErrBufferFull, err)
+	}
+	if err := arrComp(p, msg[:BufferSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arrComp(buf, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	msg := make([]byte, 100000)
+	rand.Read(msg)
+
+	go func() {
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+
+		n, err := s.ReadFrom(bytes.NewReader(msg))
+		if err != nil || n != int64(len(msg)) {
+			t.Errorf("expected to write %d bytes, wrote %d: %v", len(msg), n, err)
+		}
+	}()
+
+	s, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(msg)) {
+		t.Fatalf("expected to read %d bytes, read %d", len(msg), n)
+	}
+	if err := arrComp(buf.Bytes(), msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRandomReadSizes(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	msg := make([]byte, 200000)
+	rand.Read(msg)
+
+	go func() {
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+
+		for rest := msg; len(rest) > 0; {
+			n := rand.Intn(2*ChunkSize) + 1
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err := s.Write(rest[:n]); err != nil {
+				t.Error(err)
+				return
+			}
+			rest = rest[n:]
+		}
+	}()
+
+	s, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	for {
+		// poison the buffer so overreported reads are caught
+		buf := make([]byte, rand.Intn(3*BufferSize)+1)
+		for i := range buf {
+			buf[i] = 0xff
+		}
+		n, err := s.Read(buf)
+		if n < 0 || n > len(buf) {
+			t.Fatalf("read returned %d for a %d byte buffer", n, len(buf))
+		}
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := arrComp(got, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveQueueLength(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256, WithReceiveQueueLength(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := sa.WriteSync([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With the chunks queued for sb, the read loop carries on receiving
+	// for other streams rather than waiting for sb's reader.
+	sc, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.WriteSync([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	sd, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(sd, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunks were all received before sc's, so a single read gets them.
+	buf := make([]byte, 3)
+	n, err := sb.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arrComp(buf[:n], []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256, WithChunkSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256, WithMaxMessageSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	msg := make([]byte, 100)
+	rand.Read(msg)
+
+	go func() {
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+
+		n, err := s.Write(msg)
+		if err != nil || n != len(msg) {
+			t.Errorf("expected to write %d bytes, wrote %d: %v", len(msg), n, err)
+		}
+	}()
+
+	s, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arrComp(buf, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingMemoryManager grants every reservation, keeping track of the total.
+type countingMemoryManager struct {
+	mu       sync.Mutex
+	reserved int
+}
+
+func (m *countingMemoryManager) ReserveMemory(size int, prio uint8) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved += size
+	return nil
+}
+
+func (m *countingMemoryManager) ReleaseMemory(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved -= size
+}
+
+func TestChunkSizeReservesMemory(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	const chunkSize = 1 << 20
+	mm := &countingMemoryManager{}
+	mp, err := NewMultiplex(a, false, mm, 256, WithChunkSize(chunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mm.mu.Lock()
+	reserved := mm.reserved
+	mm.mu.Unlock()
+	if min := MaxBuffers * (chunkSize + 20); reserved < min {
+		t.Errorf("expected at least %d bytes reserved for outbound buffers, got %d", min, reserved)
+	}
+
+	mp.Close()
+	<-mp.CloseChan()
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.reserved != 0 {
+		t.Errorf("expected all memory to be released, %d bytes left", mm.reserved)
+	}
+}
+
+func TestInvalidMaxMessageSize(t *testing.T) {
+	for _, size := range []int{0, -100} {
+		a, b := net.Pipe()
+		mp, err := NewMultiplex(a, false, nil, 256, WithMaxMessageSize(size), WithDatagrams())
+		if err == nil {
+			mp.Close()
+			t.Errorf("expected a max message size of %d to be refused", size)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestInvalidChunkSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		a, b := net.Pipe()
+		mp, err := NewMultiplex(a, false, nil, 256, WithChunkSize(size))
+		if err == nil {
+			mp.Close()
+			t.Errorf("expected a chunk size of %d to be refused", size)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestInvalidReceiveQueueLength(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	mp, err := NewMultiplex(a, false, nil, 256, WithReceiveQueueLength(-1))
+	if err == nil {
+		mp.Close()
+		t.Fatal("expected a negative receive queue length to be refused")
+	}
+}
+
+func arrComp(a, b []byte) error {
+	msg := ""
+	if len(a) != len(b) {
+		msg += fmt.Sprintf("arrays differ in length: %d %d\n", len(a), len(b))
+	}
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			msg += fmt.Sprintf("content differs at index %d [%d != %d]", i, a[i], b[i])
+			return fmt.Errorf(msg)
+		}
+	}
+	if len(msg) > 0 {
+		return fmt.Errorf(msg)
+	}
+	return nil
+}
+
+func TestStreamIsClosed(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sa.IsClosed() || sb.IsClosed() {
+		t.Fatal("expected new streams to be open")
+	}
+
+	sa.CloseWrite()
+	if _, err := sb.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if sa.IsClosed() || sb.IsClosed() {
+		t.Fatal("expected half-closed streams to be open")
+	}
+
+	sa.CloseRead()
+	if !sa.IsClosed() {
+		t.Fatal("expected the stream to be closed")
+	}
+	sb.Reset()
+	if !sb.IsClosed() {
+		t.Fatal("expected the reset stream to be closed")
+	}
+
+	sc, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpa.Close()
+	if !sc.IsClosed() {
+		t.Fatal("expected streams to be closed with the session")
+	}
+}
+
+func TestStreamDone(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpb.Close()
+
+	waitDone := func(s *Stream) {
+		t.Helper()
+		select {
+		case <-s.Done():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the stream to be done")
+		}
+	}
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sa.Done():
+		t.Fatal("expected the stream to be open")
+	default:
+	}
+
+	sa.Reset()
+	waitDone(sa)
+	waitDone(sb)
+
+	// Once we stop reading, the session forgets about the stream.
+	sc, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.CloseRead()
+	sd.CloseRead()
+	sc.Done()
+	mpa.Close()
+	waitDone(sc)
+	// Done is first called after the session shut down.
+	waitDone(sd)
+
+	// WaitClosed waits for Done's watcher too.
+	closed := make(chan struct{})
+	go func() {
+		mpa.WaitClosed()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the session's goroutines")
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256, WithChunkSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer sa.Close()
+		if n, err := io.WriteString(sa, "hello world"); err != nil || n != 11 {
+			t.Errorf("expected to write 11 bytes, wrote %d: %v", n, err)
+		}
+	}()
+
+	buf, err := io.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello world" {
+		t.Fatalf("expected %q, got %q", "hello world", buf)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	a, b := net.Pipe()
+
+	var metrics testMetrics
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 2, WithMetrics(&metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	open := func() (*Stream, *Stream) {
+		t.Helper()
+		sa, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := mpb.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sa, sb
+	}
+
+	sa1, sb1 := open()
+	open()
+
+	// Streams we open don't count towards the limit, even once the peer
+	// closes them.
+	sb, err := mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, err := mpa.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa.Close()
+	if _, err := sb.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	sa3, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sa3.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected the stream over the limit to be reset, got %v", err)
+	}
+	metrics.mu.Lock()
+	if metrics.rejected != 1 {
+		t.Errorf("expected 1 rejected stream, got %d", metrics.rejected)
+	}
+	metrics.mu.Unlock()
+
+	// Once a stream goes away, there's room for another.
+	sb1.Reset()
+	if _, err := sa1.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected the stream to be reset, got %v", err)
+	}
+	sa4, sb4 := open()
+	go sa4.Write([]byte("x"))
+	if _, err := io.ReadFull(sb4, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256, WithStreamIdleTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the stream busy for longer than the timeout.
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := sb.Write([]byte("x")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	if _, err := io.ReadFull(sa, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then let it go idle.
+	start := time.Now()
+	if _, err := sb.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected the idle stream to be reset, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("reset the stream too early")
+	}
+	if !sa.IsClosed() {
+		t.Fatal("expected the stream to be closed")
+	}
+}
+
+func TestStats(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sa.WriteSync([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Stats{OpenStreams: 1, StreamsOpened: 1, BytesSent: 5, FramesSent: 2}
+	if stats := mpa.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+	expected = Stats{OpenStreams: 1, StreamsOpened: 1, BytesReceived: 5, FramesReceived: 2}
+	if stats := mpb.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	mpa.Close()
+
+	expected = Stats{StreamsOpened: 1, StreamsClosed: 1, BytesSent: 5, FramesSent: 2, Closed: true}
+	if stats := mpa.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestIDAllocator(t *testing.T) {
+	a, b := net.Pipe()
+
+	errNoIDs := errors.New("no ids left")
+	ids := []uint64{10, 20, 20}
+	alloc := func() (uint64, error) {
+		if len(ids) == 0 {
+			return 0, errNoIDs
+		}
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}
+
+	mpa, err := NewMultiplex(a, false, nil, 256, WithIDAllocator(alloc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	for _, id := range []uint64{10, 20} {
+		sa, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := mpb.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sa.ID() != id || sb.ID() != id {
+			t.Fatalf("expected both ends to have id %d, got %d and %d", id, sa.ID(), sb.ID())
+		}
+	}
+
+	if _, err := mpa.NewStream(context.Background()); err != ErrStreamIDInUse {
+		t.Fatalf("expected %v, got %v", ErrStreamIDInUse, err)
+	}
+	if _, err := mpa.NewStream(context.Background()); err != errNoIDs {
+		t.Fatalf("expected %v, got %v", errNoIDs, err)
+	}
+}
+
+func TestSendFrame(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	for _, bad := range []struct {
+		id  uint64
+		tag MessageTag
+	}{{1, 8}, {maxStreamID + 1, 0}} {
+		if err := mpa.SendFrame(context.Background(), bad.id, bad.tag, nil); err != ErrInvalidFrame {
+			t.Fatalf("expected %v, got %v", ErrInvalidFrame, err)
+		}
+	}
+
+	// Open a stream and send it some data by hand.
+	ctx := context.Background()
+	if err := mpa.SendFrame(ctx, 42, NewStreamTag, []byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpa.SendFrame(ctx, 42, MessageInitiatorTag, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.ID() != 42 {
+		t.Fatalf("expected stream 42, got %d", sb.ID())
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", buf)
+	}
+}
+
+func TestCloseUnknownStream(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	ctx := context.Background()
+	for _, tag := range []MessageTag{CloseInitiatorTag, ResetInitiatorTag, MessageInitiatorTag} {
+		if err := mpa.SendFrame(ctx, 7, tag, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := mpa.NewStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.ID() != s.ID() {
+		t.Fatalf("expected stream %d, got %d", s.ID(), sb.ID())
+	}
+	if n := mpb.NumStreams(); n != 1 {
+		t.Fatalf("expected frames for unknown streams to be ignored, got %d streams", n)
+	}
+}
+
+func TestPipePair(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go sa.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", buf)
+	}
+}
+
+func BenchmarkStreamThroughput(b *testing.B) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	go io.Copy(io.Discard, sb)
+
+	buf := make([]byte, ChunkSize)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sa.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStreamInitiator(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sa.Initiator() || sb.Initiator() {
+		t.Fatalf("expected only the opening side to be the initiator, got %t and %t", sa.Initiator(), sb.Initiator())
+	}
+}
+
+type panickingMetrics struct {
+	nullMetrics
+	onSend bool
+}
+
+func (m panickingMetrics) MessageSent(stream uint64, size int) {
+	if m.onSend {
+		panic("sent")
+	}
+}
+
+func (m panickingMetrics) MessageReceived(stream uint64, size int) {
+	if !m.onSend {
+		panic("received")
+	}
+}
+
+func TestPanicShutsDownSession(t *testing.T) {
+	for _, onSend := range []bool{false, true} {
+		mpa, mpb, err := NewPipePair(256, WithMetrics(panickingMetrics{onSend: onSend}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sa, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mpb.Accept(); err != nil {
+			t.Fatal(err)
+		}
+		sa.Write([]byte("foo"))
+
+		mp := mpb
+		if onSend {
+			mp = mpa
+		}
+		select {
+		case <-mp.CloseChan():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the session to shut down")
+		}
+		if err := mp.Err(); err == nil || !strings.Contains(err.Error(), "caught panic") {
+			t.Fatalf("expected the panic to be the session error, got %v", err)
+		}
+
+		mpa.Close()
+		mpb.Close()
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256, WithReceiveQueueLength(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := []string{"foo", "barbaz", "x"}
+	for _, f := range frames {
+		if _, err := sa.WriteSync([]byte(f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sa.Close()
+
+	for _, f := range frames {
+		frame, err := sb.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(frame) != f {
+			t.Fatalf("expected %q, got %q", f, frame)
+		}
+	}
+	if _, err := sb.ReadFrame(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestReadDelimited(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, true, nil, 256, WithChunkSize(3*BufferSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]byte, 2*BufferSize+10)
+	rand.Read(large)
+	go func() {
+		sa.Write(large)
+		sa.Write([]byte("foo"))
+		sa.Close()
+	}()
+
+	// The large message arrives in pieces of BufferSize bytes.
+	for _, exp := range []struct {
+		data     []byte
+		boundary bool
+	}{
+		{large[:BufferSize], false},
+		{large[BufferSize : 2*BufferSize], false},
+		{large[2*BufferSize:], true},
+		{[]byte("foo"), true},
+	} {
+		data, boundary, err := sb.ReadDelimited()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, exp.data) {
+			t.Fatalf("expected %d bytes, got %d different ones", len(exp.data), len(data))
+		}
+		if boundary != exp.boundary {
+			t.Fatalf("expected boundary to be %t for the %d byte piece", exp.boundary, len(data))
+		}
+	}
+	if _, _, err := sb.ReadDelimited(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+var errInjected = errors.New("injected read error")
+
+// faultyReader returns errInjected after n bytes.
+type faultyReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *faultyReader) Read(b []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errInjected
+	}
+	if len(b) > f.n {
+		b = b[:f.n]
+	}
+	n, err := f.r.Read(b)
+	f.n -= n
+	return n, err
+}
+
+func TestInjectedReadError(t *testing.T) {
+	data := []byte{
+		0, 1, '0', // open stream 0
+		2, 3, 'f', 'o', 'o', // send it some data
+		4, 0, // close it
+	}
+
+	for n := 0; n <= len(data); n++ {
+		mp, err := NewMultiplex(struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{&faultyReader{r: bytes.NewReader(data), n: n}, io.Discard, io.NopCloser(nil)}, false, nil, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-mp.CloseChan():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session didn't shut down after failing to read at %d bytes", n)
+		}
+		if err := mp.Err(); err != errInjected {
+			t.Fatalf("expected the read error at %d bytes, got %v", n, err)
+		}
+	}
+}
+
+func TestCloseWireFormat(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	mp, err := NewMultiplex(a, false, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	expect := func(expected ...byte) {
+		t.Helper()
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(b, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Fatalf("expected %v, got %v", expected, buf)
+		}
+	}
+
+	// A stream we open is closed with the initiator's tag.
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(0, 1, '0')
+	go s.CloseWrite()
+	expect(4, 0)
+
+	// A stream the peer opens is closed with the receiver's tag.
+	go b.Write([]byte{3 << 3, 0})
+	s, err = mp.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.CloseWrite()
+	expect(3<<3|3, 0)
+
+	// Same for resets.
+	go b.Write([]byte{5 << 3, 0})
+	s, err = mp.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Reset()
+	expect(5<<3|5, 0)
+}
+
+func TestResetWithError(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("aborted")
+	sa.ResetWithError(errAbort)
+
+	_, rerr := sa.Read(make([]byte, 1))
+	_, werr := sa.Write([]byte("foo"))
+	for _, err := range []error{rerr, werr} {
+		if !errors.Is(err, errAbort) || !errors.Is(err, ErrStreamReset) {
+			t.Fatalf("expected a reset error wrapping %v, got %v", errAbort, err)
+		}
+	}
+
+	if _, err := sb.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected the peer to see a plain reset, got %v", err)
+	}
+}
+
+func TestResetWithNilError(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sa.ResetWithError(nil)
+
+	_, rerr := sa.Read(make([]byte, 1))
+	_, werr := sa.Write([]byte("foo"))
+	for _, err := range []error{rerr, werr} {
+		if err != ErrStreamReset {
+			t.Fatalf("expected a plain reset, got %v", err)
+		}
+	}
+}
+
+// packetConn is one end of an in-memory message-oriented connection. Like a
+// UDP socket, it truncates packets that don't fit the read buffer.
+type packetConn struct {
+	in, out chan []byte
+	done    chan struct{}
+	once    *sync.Once
+}
+
+func newPacketConns() (*packetConn, *packetConn) {
+	ab, ba := make(chan []byte, 16), make(chan []byte, 16)
+	done, once := make(chan struct{}), new(sync.Once)
+	return &packetConn{ba, ab, done, once}, &packetConn{ab, ba, done, once}
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p), nil
+	case <-c.done:
+		return 0, io.EOF
+	}
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	select {
+	case c.out <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *packetConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func TestDatagrams(t *testing.T) {
+	a, b := newPacketConns()
+
+	// Messages larger than the read buffer can't be read in pieces, that
+	// would truncate their packets.
+	mpa, err := NewMultiplex(a, false, nil, 256, WithDatagrams(), WithChunkSize(3*BufferSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, 256, WithDatagrams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 10*BufferSize)
+	rand.Read(data)
+	go func() {
+		defer sa.Close()
+		if _, err := sa.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf, err := io.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("received data doesn't match the data sent")
+	}
+}
+
+func TestWaitClosed(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	mp, err := NewMultiplex(a, false, nil, 256, WithKeepAlive(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads from b, so these resets are stuck waiting to be sent.
+	for i := 0; i < 3; i++ {
+		s, err := mp.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Reset()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		mp.WaitClosed()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected WaitClosed to wait for the session to close")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mp.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the session's goroutines to exit")
+	}
+}
+
+func TestReceiveTimeout(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256, WithReceiveTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads from sb, so once its queue is full it gets reset.
+	go func() {
+		for {
+			if _, err := sa.Write([]byte("foo")); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-sb.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the slow stream to be reset")
+	}
+	if _, err := sb.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected %v, got %v", ErrStreamReset, err)
+	}
+}
+
+func TestReadByte(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer sa.Close()
+		// A varint, split across messages.
+		sa.Write([]byte{0xac})
+		sa.Write([]byte{0x02, 'x'})
+	}()
+
+	v, err := varint.ReadUvarint(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 300 {
+		t.Fatalf("expected 300, got %d", v)
+	}
+	if c, err := sb.ReadByte(); err != nil || c != 'x' {
+		t.Fatalf("expected 'x', got %q, %v", c, err)
+	}
+	if _, err := sb.ReadByte(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestCloseWait(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go sa.Write([]byte("foo"))
+	if _, err := io.ReadFull(sb, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// net.Pipe is synchronous, so the peer has to read the close message
+	// for it to be written.
+	done := make(chan error, 1)
+	go func() {
+		done <- sa.CloseWait(context.Background())
+	}()
+	if _, err := sb.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !sa.IsClosed() {
+		t.Fatal("expected the stream to be closed")
+	}
+	if err := sa.CloseWait(context.Background()); err != nil {
+		t.Fatalf("expected closing again to succeed, got %v", err)
+	}
+}
+
+// xorFramer obfuscates payloads, to check they go through the framer.
+type xorFramer struct {
+	PlainFramer
+}
+
+func xor(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ 0x5a
+	}
+	return out
+}
+
+func (f xorFramer) WriteFrame(w io.Writer, header uint64, payload []byte) error {
+	return f.PlainFramer.WriteFrame(w, header, xor(payload))
+}
+
+func (f xorFramer) ReadFrame(r *bufio.Reader, maxSize int) (uint64, []byte, error) {
+	header, payload, err := f.PlainFramer.ReadFrame(r, maxSize)
+	return header, xor(payload), err
+}
+
+func TestFramer(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256, WithFramer(xorFramer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewNamedStream(context.Background(), "named")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*BufferSize)
+	rand.Read(data)
+	go func() {
+		defer sa.Close()
+		if _, err := sa.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf, err := io.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("received data doesn't match the data sent")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := mpa.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksumFramer(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256, WithFramer(ChecksumFramer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sa.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", buf)
+	}
+}
+
+func TestPlainFramerReadsInPlace(t *testing.T) {
+	var frames bytes.Buffer
+	payload := make([]byte, ChunkSize)
+	for i := 0; i < 100; i++ {
+		if err := (PlainFramer{}).WriteFrame(&frames, EncodeHeader(1, MessageInitiatorTag), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bufio.NewReaderSize(&frames, BufferSize)
+	allocs := testing.AllocsPerRun(99, func() {
+		if _, p, err := (PlainFramer{}).ReadFrame(r, MaxMessageSize); err != nil || len(p) != len(payload) {
+			t.Fatalf("expected a %d byte payload, got %d: %v", len(payload), len(p), err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected reading frames not to allocate, got %v allocations per frame", allocs)
+	}
+}
+
+func TestFramerLargeMessages(t *testing.T) {
+	const size = 1 << 16
+	mpa, mpb, err := NewPipePair(256, WithFramer(ChecksumFramer{}), WithChunkSize(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, size)
+	rand.Read(msg)
+	go sa.Write(msg)
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := arrComp(buf, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	var frame bytes.Buffer
+	if err := (ChecksumFramer{}).WriteFrame(&frame, EncodeHeader(0, NewStreamTag), []byte("stream")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the header's continuation bit and the length: flipping those
+	// changes where the message ends rather than its contents.
+	for bit := 0; bit < 8*frame.Len(); bit++ {
+		if bit == 7 || bit/8 == 1 {
+			continue
+		}
+		corrupted := append([]byte(nil), frame.Bytes()...)
+		corrupted[bit/8] ^= 1 << (bit % 8)
+
+		a, b := net.Pipe()
+		mp, err := NewMultiplex(a, false, nil, 256, WithFramer(ChecksumFramer{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			b.Write(corrupted)
+			b.Close()
+		}()
+
+		<-mp.CloseChan()
+		if err := mp.Err(); err != ErrChecksumMismatch {
+			t.Fatalf("expected flipping bit %d to be detected, got %v", bit, err)
+		}
+		if _, err := mp.Accept(); err == nil {
+			t.Fatalf("accepted a stream with bit %d flipped", bit)
+		}
+		mp.Close()
+	}
+}
+
+func TestConcurrentWritesDontInterleave(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writers, size := 8, 3*ChunkSize
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := sa.Write(bytes.Repeat([]byte{byte(i)}, size)); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		sa.Close()
+	}()
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != writers*size {
+		t.Fatalf("expected %d bytes, got %d", writers*size, len(buf))
+	}
+	for i := 0; i < len(buf); i += size {
+		if !bytes.Equal(buf[i:i+size], bytes.Repeat(buf[i:i+1], size)) {
+			t.Fatalf("writes interleaved in bytes %d to %d", i, i+size)
+		}
+	}
+}
+
+func TestSetName(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewNamedStream(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := sa.Name(); name != "foo" {
+		t.Fatalf("expected name %q, got %q", "foo", name)
+	}
+	sa.SetName("bar")
+	if name := sa.Name(); name != "bar" {
+		t.Fatalf("expected name %q, got %q", "bar", name)
+	}
+}
+
+func TestNameConcurrent(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewNamedStream(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(name string) {
+			defer wg.Done()
+			sa.SetName(name)
+		}(fmt.Sprint(i))
+		go func() {
+			defer wg.Done()
+			_ = sa.Name()
+		}()
+	}
+	go func() {
+		sa.Write([]byte("hello"))
+	}()
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = sb.Name()
+	wg.Wait()
+}
+
+// countingConn counts the bytes written to it.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func TestFlush(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+
+	conn := &countingConn{Conn: a}
+	mp, err := NewMultiplex(conn, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// NewStream: 2 byte header + 1 byte name; then 10 messages of 2 + 5 bytes.
+	if n := atomic.LoadInt64(&conn.written); n != 3+10*7 {
+		t.Fatalf("expected %d bytes on the connection after flushing, got %d", 3+10*7, n)
+	}
+	if n := mp.Stats().FramesSent; n != 11 {
+		t.Fatalf("expected flushing not to count as a frame, got %d frames", n)
+	}
+
+	s.Reset()
+	if err := s.Flush(); err != ErrStreamReset {
+		t.Fatalf("expected flushing a reset stream to fail with %v, got %v", ErrStreamReset, err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- mpa.Shutdown(ctx) }()
+
+	// Wait for the shutdown to start.
+	for {
+		mpa.chLock.RLock()
+		draining := mpa.draining
+		mpa.chLock.RUnlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := mpa.NewStream(context.Background()); err != ErrShutdown {
+		t.Fatalf("expected opening a stream to fail with %v, got %v", ErrShutdown, err)
+	}
+
+	// Streams opened by the peer are reset.
+	s, err := mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected the new stream to be reset, got %v", err)
+	}
+
+	// Open streams carry on.
+	if _, err := sa.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expected Shutdown to wait for the open stream, got %v", err)
+	default:
+	}
+
+	sa.Close()
+	if _, err := io.ReadAll(sb); err != nil {
+		t.Fatal(err)
+	}
+	sb.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !mpa.IsClosed() {
+		t.Fatal("expected the session to be closed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if _, err := mpa.NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := mpa.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if !mpa.IsClosed() {
+		t.Fatal("expected the session to be closed")
+	}
+}
+
+func TestStreamByteCounters(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 3*ChunkSize)
+	rand.Read(msg)
+	done := make(chan error, 1)
+	go func() {
+		_, err := sa.Write(msg)
+		sa.Close()
+		done <- err
+	}()
+
+	// Received data only counts once it's read.
+	if _, err := sb.Peek(10); err != nil {
+		t.Fatal(err)
+	}
+	if n := sb.BytesRead(); n != 0 {
+		t.Fatalf("expected no bytes read, got %d", n)
+	}
+
+	if _, err := io.ReadFull(sb, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.ReadByte(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sb.BytesRead(); n != 11 {
+		t.Fatalf("expected 11 bytes read, got %d", n)
+	}
+
+	if _, err := io.Copy(io.Discard, sb); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := sa.BytesWritten(); n != uint64(len(msg)) {
+		t.Fatalf("expected %d bytes written, got %d", len(msg), n)
+	}
+	if n := sb.BytesRead(); n != uint64(len(msg)) {
+		t.Fatalf("expected %d bytes read, got %d", len(msg), n)
+	}
+}
+
+func TestNewStreamOnClosedSession(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpa.Close()
+	if _, err := mpa.NewStream(context.Background()); err != ErrShutdown {
+		t.Fatalf("expected %v, got %v", ErrShutdown, err)
+	}
+
+	// The peer notices once its connection is closed.
+	<-mpb.CloseChan()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := mpb.NewStream(ctx); err != ErrShutdown {
+		t.Fatalf("expected %v, got %v", ErrShutdown, err)
+	}
+}
+
+// gatedConn blocks writes while its gate is locked, and signals waiting on each
+// write.
+type gatedConn struct {
+	net.Conn
+	gate    sync.RWMutex
+	waiting chan struct{}
+}
+
+func (c *gatedConn) Write(b []byte) (int, error) {
+	select {
+	case c.waiting <- struct{}{}:
+	default:
+	}
+	c.gate.RLock()
+	defer c.gate.RUnlock()
+	return c.Conn.Write(b)
+}
+
+func TestPriority(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	var received bytes.Buffer
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		io.Copy(&received, b)
+	}()
+
+	conn := &gatedConn{Conn: a, waiting: make(chan struct{}, 1)}
+	mp, err := NewMultiplex(conn, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bulk, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	urgent, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := urgent.SetPriority(PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if p := urgent.Priority(); p != PriorityHigh {
+		t.Fatalf("expected priority %d, got %d", PriorityHigh, p)
+	}
+
+	// Hold up the write loop with the first message, and queue the rest
+	// behind it.
+	select {
+	case <-conn.waiting:
+	default:
+	}
+	conn.gate.Lock()
+	if _, err := bulk.Write([]byte("bulk1")); err != nil {
+		t.Fatal(err)
+	}
+	<-conn.waiting
+	for _, msg := range []string{"bulk2", "bulk3"} {
+		if _, err := bulk.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := urgent.Write([]byte("urgent")); err != nil {
+		t.Fatal(err)
+	}
+	conn.gate.Unlock()
+
+	if err := bulk.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	mp.Close()
+	<-readDone
+
+	var order []string
+	r := bufio.NewReader(&received)
+	for {
+		header, err := varint.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, err := varint.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, tag := DecodeHeader(header); tag == MessageInitiatorTag {
+			order = append(order, string(data))
+		}
+	}
+	if exp := []string{"bulk1", "urgent", "bulk2", "bulk3"}; fmt.Sprint(order) != fmt.Sprint(exp) {
+		t.Fatalf("expected messages in order %v, got %v", exp, order)
+	}
+}
+
+func TestWriteFairness(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	bulk, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulkIn, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIn, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const chunks = 200
+	var bulkRead int64
+	go func() {
+		buf := make([]byte, ChunkSize)
+		for {
+			n, err := bulkIn.Read(buf)
+			atomic.AddInt64(&bulkRead, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	started := make(chan struct{})
+	go func() {
+		msg := make([]byte, ChunkSize)
+		for i := 0; i < chunks; i++ {
+			if i == 1 {
+				close(started)
+			}
+			if _, err := bulk.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	// A stream writing in a tight loop doesn't get to send everything
+	// before the others get a turn.
+	<-started
+	if _, err := other.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(otherIn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&bulkRead); n >= chunks/2*int64(ChunkSize) {
+		t.Fatalf("the other stream waited for %d bytes of the bulk stream", n)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	buf := make([]byte, 5)
+	if _, err := sb.ReadContext(ctx, buf); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// The stream is still usable afterwards.
+	if _, err := sa.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := sb.ReadContext(context.Background(), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", buf[:n])
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+
+	conn := &gatedConn{Conn: a, waiting: make(chan struct{}, 1)}
+	mp, err := NewMultiplex(conn, true, nil, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stall the write loop on one message, so only the remaining outbound
+	// buffers can be queued.
+	select {
+	case <-conn.waiting:
+	default:
+	}
+	conn.gate.Lock()
+	if _, err := s.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	<-conn.waiting
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n, err := s.WriteContext(ctx, make([]byte, MaxBuffers*ChunkSize))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if exp := (MaxBuffers - 1) * ChunkSize; n != exp {
+		t.Fatalf("expected %d bytes to be queued, got %d", exp, n)
+	}
+	conn.gate.Unlock()
+
+	if _, err := s.WriteContext(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256, WithReadLimit(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sa.Write([]byte("hello"))
+		sa.Write([]byte("world"))
+		sa.Close()
+	}()
+
+	var received []byte
+	buf := make([]byte, 100)
+	for {
+		n, err := sb.Read(buf)
+		if n > 4 {
+			t.Fatalf("expected reads of at most 4 bytes, got %d", n)
+		}
+		received = append(received, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(received) != "helloworld" {
+		t.Fatalf("expected %q, got %q", "helloworld", received)
+	}
+}
+
+func TestMessageTagString(t *testing.T) {
+	for tag, exp := range map[MessageTag]string{
+		NewStreamTag:        "NewStream",
+		MessageReceiverTag:  "MessageReceiver",
+		CloseInitiatorTag:   "CloseInitiator",
+		ResetInitiatorTag:   "ResetInitiator",
+		MessageTag(pingTag): "MessageTag(7)",
+	} {
+		if s := tag.String(); s != exp {
+			t.Errorf("expected tag %d to print as %q, got %q", uint64(tag), exp, s)
+		}
+	}
+}
+
+func TestHeaderEncoding(t *testing.T) {
+	for _, id := range []uint64{0, 1, 42, maxStreamID} {
+		for tag := NewStreamTag; tag <= ResetInitiatorTag; tag++ {
+			h := EncodeHeader(id, tag)
+			if gotID, gotTag := DecodeHeader(h); gotID != id || gotTag != tag {
+				t.Fatalf("expected header %d to decode to stream %d, tag %s, got stream %d, tag %s", h, id, tag, gotID, gotTag)
+			}
+		}
+	}
+	if h := EncodeHeader(3, CloseInitiatorTag); h != 3<<3|4 {
+		t.Fatalf("expected header %d, got %d", 3<<3|4, h)
+	}
+}
+
+func TestAcceptFilter(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256, WithAcceptFilter(func(name string) bool {
+		return name != "secret"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	refused, err := mpa.NewNamedStream(context.Background(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refused.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected the refused stream to be reset, got %v", err)
+	}
+
+	accepted, err := mpa.NewNamedStream(context.Background(), "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go accepted.Write([]byte("hello"))
+
+	s, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID() != accepted.ID() {
+		t.Fatalf("expected to accept stream %d, got %d", accepted.ID(), s.ID())
+	}
+	if s.Name() != "public" {
+		t.Fatalf("expected the accepted stream to be named %q, got %q", "public", s.Name())
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcceptFilterLongName(t *testing.T) {
+	// Names are also limited by the chunk size we send.
+	filtered := make(chan string, 1)
+	mpa, mpb, err := NewPipePair(256, WithChunkSize(2*BufferSize), WithAcceptFilter(func(name string) bool {
+		filtered <- name
+		return true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewNamedStream(context.Background(), strings.Repeat("a", BufferSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected the stream to be reset, got %v", err)
+	}
+	select {
+	case name := <-filtered:
+		t.Fatalf("expected the name not to reach the filter, got %d bytes", len(name))
+	default:
+	}
+}
+
+func TestAcceptContext(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := mpb.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.AcceptContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.ID() != sa.ID() {
+		t.Fatalf("expected to accept stream %d, got %d", sa.ID(), sb.ID())
+	}
+}
+
+func TestShutdownWaitsForReply(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	// The peer sends a request and closes its side.
+	req, err := mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := req.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	req.CloseWrite()
+
+	s, err := mpa.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(s); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- mpa.Shutdown(ctx) }()
+
+	for {
+		mpa.chLock.RLock()
+		draining := mpa.draining
+		mpa.chLock.RUnlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// We still get to reply.
+	if _, err := s.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expected Shutdown to wait for the reply, got %v", err)
+	default:
+	}
+	s.CloseWrite()
+
+	reply, err := io.ReadAll(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "reply" {
+		t.Fatalf("expected %q, got %q", "reply", reply)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseGracefulPeerClosedStream(t *testing.T) {
+	mpa, mpb, err := NewPipePair(256, WithReceiveQueueLength(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	req, err := mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.CloseWrite()
+
+	s, err := mpa.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(s); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"foo", "bar", "baz"} {
+		if _, err := s.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mpa.CloseGraceful(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer got everything, and our close.
+	reply, err := io.ReadAll(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "foobarbaz" {
+		t.Fatalf("expected %q, got %q", "foobarbaz", reply)
+	}
+}
+
+func TestRejectedStreamsDontPileUp(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	metrics := &testMetrics{}
+	mp, err := NewMultiplex(a, false, nil, 0, WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	before := runtime.NumGoroutine()
+
+	// The peer opens streams past the limit, and gets a reset for each.
+	const streams = 2000
+	resets := make(chan int, 1)
+	go func() {
+		r := bufio.NewReader(b)
+		n := 0
+		for n < streams {
+			h, err := varint.ReadUvarint(r)
+			if err != nil {
+				break
+			}
+			if _, err := varint.ReadUvarint(r); err != nil {
+				break
+			}
+			if _, tag := DecodeHeader(h); tag == ResetReceiverTag {
+				n++
+			}
+		}
+		resets <- n
+	}()
+
+	var frames []byte
+	for i := uint64(0); i < streams; i++ {
+		frames = append(frames, varint.ToUvarint(EncodeHeader(i, NewStreamTag))...)
+		frames = append(frames, 0)
+	}
+	if _, err := b.Write(frames); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the read loop to get through them.
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		metrics.mu.Lock()
+		rejected := metrics.rejected
+		metrics.mu.Unlock()
+		if rejected == streams {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected %d streams to be refused, got %d", streams, rejected)
+		}
+	}
+
+	if n := runtime.NumGoroutine() - before; n > 10 {
+		t.Fatalf("expected refused streams not to pile up goroutines, got %d more", n)
+	}
+
+	select {
+	case n := <-resets:
+		if n != streams {
+			t.Fatalf("expected %d resets, got %d", streams, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the resets")
 	}
-	return nil
 }
@@ -0,0 +1,149 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Pings aren't part of the mplex spec. They're sent with the one tag the spec
+// leaves unused, on a stream id we never open. Peers that don't know about
+// pings may treat the unknown tag as a protocol error and close the connection
+// (rust-libp2p does), so only ping peers known to support them.
+const (
+	pingTag      = 7
+	pingStreamID = maxStreamID
+
+	// a ping carries a one byte kind followed by an 8 byte nonce
+	pingMsgLen = 9
+
+	pingKind = 0
+	pongKind = 1
+)
+
+// WithKeepAlive makes the session ping the peer every interval, and shut down
+// if the peer doesn't answer within the interval. Only use this if the peer is
+// known to support pings: others may close the connection, see Ping.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(mp *Multiplex) {
+		mp.keepAliveInterval = interval
+	}
+}
+
+// Ping sends a ping to the peer and waits for the response, returning the
+// round-trip time.
+//
+// Pings are an extension to the mplex protocol: only ping peers known to
+// support them. A peer that doesn't may close the connection, or drop the ping
+// so that Ping blocks until ctx is done.
+func (mp *Multiplex) Ping(ctx context.Context) (time.Duration, error) {
+	pong := make(chan struct{})
+
+	mp.pingLock.Lock()
+	mp.pingNonce++
+	nonce := mp.pingNonce
+	mp.pings[nonce] = pong
+	mp.pingLock.Unlock()
+
+	defer func() {
+		mp.pingLock.Lock()
+		delete(mp.pings, nonce)
+		mp.pingLock.Unlock()
+	}()
+
+	start := time.Now()
+	if err := mp.sendPing(ctx.Done(), pingKind, nonce); err != nil {
+		if err == errTimeout {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-mp.closed:
+		return 0, ErrShutdown
+	}
+}
+
+func (mp *Multiplex) sendPing(timeout <-chan struct{}, kind byte, nonce uint64) error {
+	var payload [pingMsgLen]byte
+	payload[0] = kind
+	binary.BigEndian.PutUint64(payload[1:], nonce)
+	return mp.sendMsg(timeout, nil, EncodeHeader(pingStreamID, pingTag), payload[:])
+}
+
+// handlePing handles a ping or pong from the peer. It's called from the read
+// loop.
+func (mp *Multiplex) handlePing(mlen int) error {
+	if mlen != pingMsgLen {
+		mp.log.Debugf("received ping with unexpected length %d", mlen)
+		return mp.skipNextMsg(mlen)
+	}
+
+	var payload [pingMsgLen]byte
+	if _, err := io.ReadFull(mp.body(), payload[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	nonce := binary.BigEndian.Uint64(payload[1:])
+
+	switch payload[0] {
+	case pingKind:
+		// Answer in the background so we don't hold up the read loop, but
+		// only one at a time so a peer can't make us pile up goroutines.
+		if !atomic.CompareAndSwapInt32(&mp.ponging, 0, 1) {
+			return nil
+		}
+		mp.spawn(func() {
+			defer atomic.StoreInt32(&mp.ponging, 0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), ResetStreamTimeout)
+			defer cancel()
+
+			if err := mp.sendPing(ctx.Done(), pongKind, nonce); err != nil {
+				mp.log.Debugf("error sending pong: %s", err)
+			}
+		})
+	case pongKind:
+		mp.pingLock.Lock()
+		pong, ok := mp.pings[nonce]
+		delete(mp.pings, nonce)
+		mp.pingLock.Unlock()
+		if ok {
+			close(pong)
+		}
+	default:
+		mp.log.Debugf("received ping of unknown kind %d", payload[0])
+	}
+	return nil
+}
+
+func (mp *Multiplex) keepAlive() {
+	ticker := time.NewTicker(mp.keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-mp.closed:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), mp.keepAliveInterval)
+		_, err := mp.Ping(ctx)
+		cancel()
+		if err != nil {
+			if !mp.isShutdown() {
+				mp.log.Warnf("keepalive ping failed: %s; killing connection", err)
+				mp.closeWithError(fmt.Errorf("keepalive ping failed: %w", err))
+			}
+			return
+		}
+	}
+}
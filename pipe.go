@@ -0,0 +1,24 @@
+package multiplex
+
+import "net"
+
+// NewPipePair returns two sessions connected to each other over an in-memory
+// net.Pipe, for tests and benchmarks. The first one is the initiator. Options
+// apply to both sessions.
+func NewPipePair(maxStreams uint32, opts ...Option) (*Multiplex, *Multiplex, error) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, true, nil, maxStreams, opts...)
+	if err != nil {
+		a.Close()
+		b.Close()
+		return nil, nil, err
+	}
+	mpb, err := NewMultiplex(b, false, nil, maxStreams, opts...)
+	if err != nil {
+		mpa.Close()
+		b.Close()
+		return nil, nil, err
+	}
+	return mpa, mpb, nil
+}
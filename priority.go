@@ -0,0 +1,61 @@
+package multiplex
+
+import "sync/atomic"
+
+// Priority decides which streams' messages are written first when several are
+// waiting, see Stream.SetPriority.
+type Priority int32
+
+const (
+	// PriorityNormal is the priority streams start out with.
+	PriorityNormal Priority = iota
+	// PriorityHigh streams have their messages written before those of
+	// PriorityNormal streams, so bulk transfers don't hold them up.
+	PriorityHigh
+)
+
+// Priority returns the stream's priority.
+func (s *Stream) Priority() Priority {
+	return Priority(atomic.LoadInt32(&s.priority))
+}
+
+// SetPriority changes the stream's priority. Priorities only order messages
+// that are already queued: writers on all streams still share the session's
+// outbound buffers (see MaxBuffers), so a high priority write may have to wait
+// for one to come free.
+//
+// So that the peer receives the stream's messages in order, SetPriority waits
+// for the messages queued at the old priority to be written first. Like Flush,
+// it gives up at the write deadline.
+func (s *Stream) SetPriority(p Priority) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if p == s.Priority() {
+		return nil
+	}
+
+	// Once the stream is closed for writing there's nothing left to
+	// reorder, bar a reset.
+	if !isClosedChan(s.writeCancel) {
+		if err := s.mp.flush(s.wDeadline.wait(), s.writeCancel); err != nil {
+			return err
+		}
+	}
+
+	atomic.StoreInt32(&s.priority, int32(p))
+	return nil
+}
+
+// queue returns the write queue for the stream's priority.
+func (s *Stream) queue() chan<- outMsg {
+	if s.Priority() == PriorityHigh {
+		return s.mp.writeChHigh
+	}
+	return s.mp.writeCh
+}
+
+// sendMsgAck queues one of the stream's messages, at the stream's priority.
+func (s *Stream) sendMsgAck(timeout, cancel <-chan struct{}, header uint64, data []byte, ack chan<- error) error {
+	return s.mp.queueMsg(s.queue(), timeout, cancel, nil, header, data, ack)
+}
@@ -0,0 +1,42 @@
+package multiplex
+
+import "sync/atomic"
+
+// Stats is a snapshot of a session's counters, see Multiplex.Stats.
+type Stats struct {
+	// OpenStreams is the number of streams still receiving data, as
+	// reported by NumStreams.
+	OpenStreams int
+	// StreamsOpened and StreamsClosed count the streams opened by either
+	// side, and the streams that stopped receiving data, like the Metrics
+	// events of the same name.
+	StreamsOpened, StreamsClosed uint64
+	// BytesSent and BytesReceived count the payload bytes of data messages.
+	BytesSent, BytesReceived uint64
+	// FramesSent and FramesReceived count all messages, including those
+	// opening, closing and resetting streams.
+	FramesSent, FramesReceived uint64
+	// Closed is true once the session has shut down.
+	Closed bool
+}
+
+// counters backs Stats. Its fields are accessed atomically.
+type counters struct {
+	streamsOpened, streamsClosed uint64
+	bytesSent, bytesReceived     uint64
+	framesSent, framesReceived   uint64
+}
+
+// Stats returns a snapshot of the session's counters.
+func (mp *Multiplex) Stats() Stats {
+	return Stats{
+		OpenStreams:    mp.NumStreams(),
+		StreamsOpened:  atomic.LoadUint64(&mp.stats.streamsOpened),
+		StreamsClosed:  atomic.LoadUint64(&mp.stats.streamsClosed),
+		BytesSent:      atomic.LoadUint64(&mp.stats.bytesSent),
+		BytesReceived:  atomic.LoadUint64(&mp.stats.bytesReceived),
+		FramesSent:     atomic.LoadUint64(&mp.stats.framesSent),
+		FramesReceived: atomic.LoadUint64(&mp.stats.framesReceived),
+		Closed:         mp.IsClosed(),
+	}
+}
@@ -1,12 +1,17 @@
 package multiplex
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	pool "github.com/libp2p/go-buffer-pool"
 	"go.uber.org/multierr"
 )
 
@@ -15,6 +20,41 @@ var (
 	ErrStreamClosed = errors.New("closed stream")
 )
 
+// resetError is the error of streams reset with ResetWithError.
+type resetError struct {
+	err error
+}
+
+func (e *resetError) Error() string        { return "stream reset: " + e.err.Error() }
+func (e *resetError) Unwrap() error        { return e.err }
+func (e *resetError) Is(target error) bool { return target == ErrStreamReset }
+
+var (
+	_ net.Conn        = (*Stream)(nil)
+	_ io.StringWriter = (*Stream)(nil)
+	_ io.ByteReader   = (*Stream)(nil)
+)
+
+// Addr is the address of one end of a stream.
+type Addr struct {
+	// Conn is the address of this end of the underlying connection, or nil
+	// if the connection doesn't have one.
+	Conn net.Addr
+	// Stream is the id of the stream.
+	Stream uint64
+}
+
+func (a *Addr) Network() string {
+	return "mplex"
+}
+
+func (a *Addr) String() string {
+	if a.Conn == nil {
+		return fmt.Sprint(a.Stream)
+	}
+	return fmt.Sprintf("%s/%d", a.Conn, a.Stream)
+}
+
 // streamID is a convenience type for operating on stream IDs
 type streamID struct {
 	id        uint64
@@ -22,21 +62,45 @@ type streamID struct {
 }
 
 // header computes the header for the given tag
-func (id *streamID) header(tag uint64) uint64 {
-	header := id.id<<3 | tag
+func (id *streamID) header(tag MessageTag) uint64 {
+	header := EncodeHeader(id.id, tag)
 	if !id.initiator {
 		header--
 	}
 	return header
 }
 
+// received is a chunk of a received message.
+type received struct {
+	data []byte
+	// more is set if the message continues in the next chunk
+	more bool
+}
+
 type Stream struct {
-	id     streamID
-	name   string
-	dataIn chan []byte
+	// bytesRead and bytesWritten are accessed atomically, they come first
+	// to keep them 64-bit aligned
+	bytesRead, bytesWritten uint64
+
+	id streamID
+
+	nameLock sync.Mutex
+	name     string
+
+	// dataIn holds received chunks of at most BufferSize bytes, one by
+	// default (see WithReceiveQueueLength). Together with extra, a stream
+	// never buffers more than one chunk beyond that, or two while a Peek
+	// gathers its bytes; the read loop blocks (see WithReceiveTimeout)
+	// rather than buffering more. Chunks come out of
+	// the session's inbound buffers, so all streams together never buffer
+	// more than MaxBuffers chunks.
+	dataIn chan received
 	mp     *Multiplex
 
 	extra []byte
+	// more is set if the message extra belongs to continues in the next
+	// chunk
+	more bool
 
 	// exbuf is for holding the reference to the beginning of the extra slice
 	// for later memory pool freeing
@@ -44,15 +108,78 @@ type Stream struct {
 
 	rDeadline, wDeadline pipeDeadline
 
+	// readLock is held for the duration of Read, it guards extra and exbuf
+	readLock sync.Mutex
+	// writeLock is held for the duration of Write, so concurrent writes
+	// don't interleave their chunks
+	writeLock sync.Mutex
+	// priority is the stream's Priority, accessed atomically. It's only
+	// changed with writeLock held.
+	priority int32
+
 	clLock                        sync.Mutex
 	writeCancelErr, readCancelErr error
 	writeCancel, readCancel       chan struct{}
+
+	// closed is closed once both writeCancel and readCancel are, or, if
+	// anyone is waiting on Done, when the session shuts down.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// idleTimer resets the stream once it has been idle for too long, see
+	// WithStreamIdleTimeout. It's nil if there's no idle timeout.
+	idleTimer *time.Timer
 }
 
+// Name returns the stream's name: the one it was opened with, unless it has
+// been changed with SetName.
 func (s *Stream) Name() string {
+	s.nameLock.Lock()
+	defer s.nameLock.Unlock()
 	return s.name
 }
 
+// SetName changes the name Name returns. It's purely local, the peer keeps
+// the name the stream was opened with.
+func (s *Stream) SetName(name string) {
+	s.nameLock.Lock()
+	defer s.nameLock.Unlock()
+	s.name = name
+}
+
+// BytesRead returns how many bytes have been read from the stream. Data that
+// has been received but not read yet doesn't count.
+func (s *Stream) BytesRead() uint64 {
+	return atomic.LoadUint64(&s.bytesRead)
+}
+
+// BytesWritten returns how many bytes have been written to the stream. Written
+// bytes count once they're queued, they may not have reached the connection yet.
+func (s *Stream) BytesWritten() uint64 {
+	return atomic.LoadUint64(&s.bytesWritten)
+}
+
+// LocalAddr returns the local address of the stream.
+func (s *Stream) LocalAddr() net.Addr {
+	return &Addr{Conn: s.mp.laddr, Stream: s.id.id}
+}
+
+// RemoteAddr returns the remote address of the stream.
+func (s *Stream) RemoteAddr() net.Addr {
+	return &Addr{Conn: s.mp.raddr, Stream: s.id.id}
+}
+
+// ID returns the stream's id. Ids are only unique together with the side that
+// opened the stream.
+func (s *Stream) ID() uint64 {
+	return s.id.id
+}
+
+// Initiator reports whether we opened the stream, as opposed to the peer.
+func (s *Stream) Initiator() bool {
+	return s.id.initiator
+}
+
 // tries to preload pending data
 func (s *Stream) preloadData() {
 	select {
@@ -60,30 +187,38 @@ func (s *Stream) preloadData() {
 		if !ok {
 			return
 		}
-		s.extra = read
-		s.exbuf = read
+		s.extra, s.exbuf, s.more = read.data, read.data, read.more
 	default:
 	}
 }
 
-func (s *Stream) waitForData() error {
+func (s *Stream) waitForData(ctx context.Context) error {
 	select {
 	case read, ok := <-s.dataIn:
 		if !ok {
 			return io.EOF
 		}
-		s.extra = read
-		s.exbuf = read
+		s.extra, s.exbuf, s.more = read.data, read.data, read.more
 		return nil
 	case <-s.readCancel:
-		// This is the only place where it's safe to return these.
+		// Drop anything still buffered.
 		s.returnBuffers()
 		return s.readCancelErr
 	case <-s.rDeadline.wait():
 		return errTimeout
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// releaseBuffers waits for any in-progress Read to return and then returns all
+// buffered data to the pool. Reads must already be canceled.
+func (s *Stream) releaseBuffers() {
+	s.readLock.Lock()
+	s.returnBuffers()
+	s.readLock.Unlock()
+}
+
 func (s *Stream) returnBuffers() {
 	if s.exbuf != nil {
 		s.mp.putBufferInbound(s.exbuf)
@@ -96,25 +231,52 @@ func (s *Stream) returnBuffers() {
 			if !ok {
 				return
 			}
-			if read == nil {
+			if read.data == nil {
 				continue
 			}
-			s.mp.putBufferInbound(read)
+			s.mp.putBufferInbound(read.data)
 		default:
 			return
 		}
 	}
 }
 
+// Read reads data from the stream. When the peer closes the stream, any data
+// it sent beforehand is still returned before io.EOF.
+//
+// Read copies into b and never retains it. Received data is held in pooled
+// buffers until it has been read, or until reading is canceled by CloseRead,
+// Reset or the session shutting down, at which point the buffers are released.
 func (s *Stream) Read(b []byte) (int, error) {
+	return s.ReadContext(context.Background(), b)
+}
+
+// ReadContext is like Read, but gives up once ctx is done, returning ctx's
+// error. Nothing is lost when it does: data that arrives afterwards is left
+// for the next read.
+func (s *Stream) ReadContext(ctx context.Context, b []byte) (int, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
 	select {
 	case <-s.readCancel:
 		return 0, s.readCancelErr
 	default:
 	}
 
+	// A deadline in the past fails the call, even if data is buffered.
+	if isClosedChan(s.rDeadline.wait()) {
+		return 0, errTimeout
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if limit := s.mp.readLimit; limit > 0 && len(b) > limit {
+		b = b[:limit]
+	}
+
 	if s.extra == nil {
-		err := s.waitForData()
+		err := s.waitForData(ctx)
 		if err != nil {
 			return 0, err
 		}
@@ -134,18 +296,389 @@ func (s *Stream) Read(b []byte) (int, error) {
 			s.preloadData()
 		}
 	}
+	atomic.AddUint64(&s.bytesRead, uint64(n))
+	s.touch()
 	return n, nil
 }
 
+// ReadByte reads a single byte from the stream, like Read.
+func (s *Stream) ReadByte() (byte, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	select {
+	case <-s.readCancel:
+		return 0, s.readCancelErr
+	default:
+	}
+
+	if isClosedChan(s.rDeadline.wait()) {
+		return 0, errTimeout
+	}
+
+	if s.extra == nil {
+		if err := s.waitForData(context.Background()); err != nil {
+			return 0, err
+		}
+	}
+
+	c := s.extra[0]
+	if len(s.extra) > 1 {
+		s.extra = s.extra[1:]
+	} else {
+		if s.exbuf != nil {
+			s.mp.putBufferInbound(s.exbuf)
+		}
+		s.extra = nil
+		s.exbuf = nil
+		s.preloadData()
+	}
+	atomic.AddUint64(&s.bytesRead, 1)
+	s.touch()
+	return c, nil
+}
+
+// Peek returns the next n bytes without consuming them, waiting for them to
+// arrive if needed; later reads still return them. If the stream ends or an
+// error occurs first, Peek returns the bytes it has along with the error. The
+// returned slice is only valid until the next read.
+//
+// Peek looks at most BufferSize bytes ahead: for a larger n, it returns the
+// first BufferSize bytes and bufio.ErrBufferFull.
+func (s *Stream) Peek(n int) ([]byte, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	select {
+	case <-s.readCancel:
+		return nil, s.readCancelErr
+	default:
+	}
+
+	if isClosedChan(s.rDeadline.wait()) {
+		return nil, errTimeout
+	}
+
+	if n <= 0 {
+		return nil, nil
+	}
+
+	var err error
+	if n > BufferSize {
+		n, err = BufferSize, bufio.ErrBufferFull
+	}
+
+	if s.extra == nil {
+		if err := s.waitForData(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
+	for len(s.extra) < n {
+		// Gather the chunks in a buffer of our own, reads don't care
+		// whether extra came from the pool.
+		if s.exbuf != nil {
+			buf := make([]byte, len(s.extra), n)
+			copy(buf, s.extra)
+			s.mp.putBufferInbound(s.exbuf)
+			s.extra = buf
+			s.exbuf = nil
+		}
+
+		select {
+		case read, ok := <-s.dataIn:
+			if !ok {
+				return s.extra, io.EOF
+			}
+			s.extra = append(s.extra, read.data...)
+			s.more = read.more
+			s.mp.putBufferInbound(read.data)
+		case <-s.readCancel:
+			return nil, s.readCancelErr
+		case <-s.rDeadline.wait():
+			return s.extra, errTimeout
+		}
+	}
+	return s.extra[:n], err
+}
+
+// ReadFrame returns the payload of the next message received on the stream,
+// keeping the message boundaries that Read doesn't. Each Write of at most the
+// chunk size is sent as a single message. Received messages are split at
+// BufferSize, whoever sent them: one larger than that, as a peer with a larger
+// chunk size (see WithChunkSize) may send, is returned in pieces of up to
+// BufferSize bytes. Empty messages carry nothing and are skipped.
+//
+// ReadFrame returns io.EOF once the peer has closed the stream. Don't mix it
+// with Read or other reads on the same stream, a partial read leaves the rest
+// of its message to be returned as a frame of its own.
+func (s *Stream) ReadFrame() ([]byte, error) {
+	chunk, buf, _, err := s.nextChunk()
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, len(chunk))
+	copy(frame, chunk)
+	atomic.AddUint64(&s.bytesRead, uint64(len(chunk)))
+	if buf != nil {
+		s.mp.putBufferInbound(buf)
+	}
+	return frame, nil
+}
+
+// ReadDelimited is like ReadFrame, but also reports whether data ends a
+// message: of the pieces a message larger than BufferSize is returned in, only
+// the last is a boundary. Unlike ReadFrame, it can be mixed with Read, which
+// leaves the rest of a partially read message to ReadDelimited.
+func (s *Stream) ReadDelimited() (data []byte, boundary bool, err error) {
+	chunk, buf, more, err := s.nextChunk()
+	if err != nil {
+		return nil, false, err
+	}
+
+	data = make([]byte, len(chunk))
+	copy(data, chunk)
+	atomic.AddUint64(&s.bytesRead, uint64(len(chunk)))
+	if buf != nil {
+		s.mp.putBufferInbound(buf)
+	}
+	return data, !more, nil
+}
+
+// WriteTo writes data received on the stream to w until the peer closes the
+// stream or an error occurs. It implements io.WriterTo, handing received chunks
+// to w without copying them first.
+//
+// Like Read, WriteTo must not be called concurrently with other reads.
+func (s *Stream) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		chunk, buf, more, err := s.nextChunk()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+
+		n, err := w.Write(chunk)
+		written += int64(n)
+		atomic.AddUint64(&s.bytesRead, uint64(n))
+		if n < len(chunk) {
+			s.unreadChunk(chunk[n:], buf, more)
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return written, err
+		}
+		if buf != nil {
+			s.mp.putBufferInbound(buf)
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// nextChunk takes the next chunk of received data, waiting for it if needed.
+// The caller owns buf, which must be returned with putBufferInbound.
+func (s *Stream) nextChunk() (chunk, buf []byte, more bool, err error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	select {
+	case <-s.readCancel:
+		return nil, nil, false, s.readCancelErr
+	default:
+	}
+
+	if isClosedChan(s.rDeadline.wait()) {
+		return nil, nil, false, errTimeout
+	}
+
+	if s.extra == nil {
+		if err := s.waitForData(context.Background()); err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	chunk, buf, more = s.extra, s.exbuf, s.more
+	s.extra, s.exbuf = nil, nil
+	s.touch()
+	return chunk, buf, more, nil
+}
+
+// unreadChunk puts back the unread part of a chunk taken with nextChunk.
+func (s *Stream) unreadChunk(chunk, buf []byte, more bool) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	// If reads were canceled, the buffers may already have been released.
+	if isClosedChan(s.readCancel) {
+		if buf != nil {
+			s.mp.putBufferInbound(buf)
+		}
+		return
+	}
+	s.extra, s.exbuf, s.more = chunk, buf, more
+}
+
+// ReadFrom writes data read from r to the stream until r returns io.EOF or an
+// error occurs. It implements io.ReaderFrom, reading from r in chunks of the
+// session's chunk size.
+func (s *Stream) ReadFrom(r io.Reader) (int64, error) {
+	buf := pool.Get(s.mp.chunkSize)
+	defer pool.Put(buf)
+
+	var read int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := s.Write(buf[:n]); err != nil {
+				return read, err
+			}
+			read += int64(n)
+		}
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// Write writes b to the stream, split into as many messages as needed to stay
+// within the session's chunk size. Writing an empty slice sends nothing: mplex
+// has no use for empty messages.
+//
+// Each chunk is copied before being queued, so b isn't retained. Across all
+// streams, at most one chunk per outbound buffer reserved from the
+// MemoryManager (MaxBuffers) is queued at a time; once they're all in use,
+// writes block until a queued chunk has been written to the connection.
+//
+// Writes from several goroutines are sent one after the other, so the data of
+// each arrives contiguously, never interleaved with that of another write.
 func (s *Stream) Write(b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	return s.writeChunks(context.Background(), b, nil)
+}
+
+// WriteContext is like Write, but gives up once ctx is done, returning ctx's
+// error along with how much of b was queued before that.
+func (s *Stream) WriteContext(ctx context.Context, b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	n, err := s.writeChunks(ctx, b, nil)
+	if err == errCanceled {
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+// WriteBuffers writes bufs to the stream as if they were a single slice. The
+// slices are packed into as few messages as the chunk size allows, instead of
+// sending at least one message per slice.
+func (s *Stream) WriteBuffers(bufs net.Buffers) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	chunk := pool.Get(s.mp.chunkSize)
+	defer pool.Put(chunk)
+
+	var written, n int
+	for _, b := range bufs {
+		for len(b) > 0 {
+			c := copy(chunk[n:], b)
+			n += c
+			b = b[c:]
+			if n < len(chunk) {
+				continue
+			}
+			if _, err := s.write(context.Background(), chunk, nil); err != nil {
+				return written, err
+			}
+			written += n
+			n = 0
+		}
+	}
+	if n > 0 {
+		if _, err := s.write(context.Background(), chunk[:n], nil); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// WriteString is like Write, but takes a string so callers don't need to
+// convert it to a byte slice first.
+func (s *Stream) WriteString(str string) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	chunk := pool.Get(s.mp.chunkSize)
+	defer pool.Put(chunk)
+
+	var written int
+	for written < len(str) {
+		n := copy(chunk, str[written:])
+		if _, err := s.write(context.Background(), chunk[:n], nil); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// WriteSync is like Write, but only returns once the data has actually been
+// written to the underlying connection, or writing it failed.
+//
+// Once data has been queued, WriteSync waits for the result regardless of the
+// write deadline.
+func (s *Stream) WriteSync(b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	return s.writeChunks(context.Background(), b, make(chan error, 1))
+}
+
+// Flush waits until everything written to the stream so far has been written to
+// the underlying connection. Writes on other streams queued in the meantime are
+// flushed along with it.
+//
+// Like Write, Flush gives up at the write deadline, or once the stream is
+// closed for writing.
+func (s *Stream) Flush() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	select {
+	case <-s.writeCancel:
+		return s.writeCancelErr
+	default:
+	}
+
+	if isClosedChan(s.wDeadline.wait()) {
+		return errTimeout
+	}
+
+	return s.mp.flush(s.wDeadline.wait(), s.writeCancel)
+}
+
+func (s *Stream) writeChunks(ctx context.Context, b []byte, ack chan error) (int, error) {
 	var written int
 	for written < len(b) {
 		wl := len(b) - written
-		if wl > ChunkSize {
-			wl = ChunkSize
+		if wl > s.mp.chunkSize {
+			wl = s.mp.chunkSize
 		}
 
-		n, err := s.write(b[written : written+wl])
+		n, err := s.write(ctx, b[written:written+wl], ack)
 		if err != nil {
 			return written, err
 		}
@@ -156,17 +689,37 @@ func (s *Stream) Write(b []byte) (int, error) {
 	return written, nil
 }
 
-func (s *Stream) write(b []byte) (int, error) {
+func (s *Stream) write(ctx context.Context, b []byte, ack chan error) (int, error) {
 	select {
 	case <-s.writeCancel:
 		return 0, s.writeCancelErr
 	default:
 	}
 
-	err := s.mp.sendMsg(s.wDeadline.wait(), s.writeCancel, s.id.header(messageTag), b)
+	if isClosedChan(s.wDeadline.wait()) {
+		return 0, errTimeout
+	}
+	if ctx.Err() != nil {
+		return 0, errCanceled
+	}
+
+	err := s.mp.queueMsg(s.queue(), s.wDeadline.wait(), s.writeCancel, ctx.Done(), s.id.header(MessageInitiatorTag), b, ack)
 	if err != nil {
 		return 0, err
 	}
+	atomic.AddUint64(&s.bytesWritten, uint64(len(b)))
+	s.touch()
+
+	if ack != nil {
+		select {
+		case err := <-ack:
+			if err != nil {
+				return 0, err
+			}
+		case <-s.mp.shutdown:
+			return 0, s.mp.closeError()
+		}
+	}
 
 	return len(b), nil
 }
@@ -175,39 +728,54 @@ func (s *Stream) cancelWrite(err error) bool {
 	s.wDeadline.close()
 
 	s.clLock.Lock()
-	defer s.clLock.Unlock()
 	select {
 	case <-s.writeCancel:
+		s.clLock.Unlock()
 		return false
 	default:
 		s.writeCancelErr = err
 		close(s.writeCancel)
-		return true
+		s.checkClosed()
 	}
+	s.clLock.Unlock()
+
+	// Not under clLock: the session takes it with chLock held.
+	s.mp.unregisterWriter(s.id)
+	return true
 }
 
 func (s *Stream) cancelRead(err error) bool {
 	// Always unregister for reading first, even if we're already closed (or
 	// already closing). When handleIncoming calls this, it expects the
 	// stream to be unregistered by the time it returns.
-	s.mp.chLock.Lock()
-	delete(s.mp.channels, s.id)
-	s.mp.chLock.Unlock()
+	s.mp.unregisterStream(s.id)
 
 	s.rDeadline.close()
 
 	s.clLock.Lock()
-	defer s.clLock.Unlock()
 	select {
 	case <-s.readCancel:
+		s.clLock.Unlock()
 		return false
 	default:
 		s.readCancelErr = err
 		close(s.readCancel)
-		return true
+		s.checkClosed()
 	}
+	s.clLock.Unlock()
+
+	// Nobody is going to read what we buffered, don't hold on to it.
+	s.releaseBuffers()
+	return true
 }
 
+// CloseWrite closes the stream for writing, telling the peer we're done. Any
+// further writes fail, but the stream can still be read from until the peer
+// closes its end too.
+//
+// The close message is never dropped: if the session is too busy to queue it,
+// CloseWrite waits for up to ResetStreamTimeout before giving up and closing
+// the session.
 func (s *Stream) CloseWrite() error {
 	if !s.cancelWrite(ErrStreamClosed) {
 		// Check if we closed the stream _nicely_. If so, we don't need
@@ -222,30 +790,143 @@ func (s *Stream) CloseWrite() error {
 	ctx, cancel := context.WithTimeout(context.Background(), ResetStreamTimeout)
 	defer cancel()
 
-	err := s.mp.sendMsg(ctx.Done(), nil, s.id.header(closeTag), nil)
+	err := s.sendMsgAck(ctx.Done(), nil, s.id.header(CloseInitiatorTag), nil, nil)
 	// We failed to close the stream after 2 minutes, something is probably wrong.
 	if err != nil && !s.mp.isShutdown() {
-		log.Warnf("Error closing stream: %s; killing connection", err.Error())
+		s.mp.log.Warnf("Error closing stream: %s; killing connection", err.Error())
 		s.mp.Close()
 	}
 	return err
 }
 
+// CloseRead stops reading from the stream. Any data that was received but not
+// yet read is discarded.
 func (s *Stream) CloseRead() error {
 	s.cancelRead(ErrStreamClosed)
 	return nil
 }
 
+// Close closes the stream for both reading and writing. Use CloseWrite to keep
+// reading the peer's response.
 func (s *Stream) Close() error {
 	return multierr.Combine(s.CloseRead(), s.CloseWrite())
 }
 
+// CloseWait is like Close, but waits until the close message has actually been
+// written to the connection, or ctx is done. If ctx is done before the message
+// could even be queued, the stream is reset instead, so that the peer still
+// hears about it. If the stream was already closed for writing, CloseWait
+// returns right away.
+func (s *Stream) CloseWait(ctx context.Context) error {
+	s.CloseRead()
+
+	if !s.cancelWrite(ErrStreamClosed) {
+		if s.writeCancelErr == ErrStreamClosed {
+			return nil
+		}
+		return s.writeCancelErr
+	}
+
+	ack := make(chan error, 1)
+	err := s.sendMsgAck(ctx.Done(), nil, s.id.header(CloseInitiatorTag), nil, ack)
+	if err == errTimeout {
+		s.mp.spawn(func() { s.mp.sendResetMsg(s.id.header(ResetInitiatorTag), true) })
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.mp.shutdown:
+		return s.mp.closeError()
+	}
+}
+
+// IsClosed reports whether the stream is closed for both reading and writing,
+// whether by Close, Reset, the peer resetting it, or the session shutting
+// down. A stream the peer has merely closed its end of isn't closed until the
+// user closes it too.
+func (s *Stream) IsClosed() bool {
+	return isClosedChan(s.closed) || isClosedChan(s.mp.closed)
+}
+
+// Done returns a channel that's closed once the stream is closed, as reported
+// by IsClosed.
+func (s *Stream) Done() <-chan struct{} {
+	s.closeOnce.Do(func() {
+		// Streams that aren't registered with the session anymore (e.g.,
+		// because we stopped reading) don't hear about it shutting down.
+		ok := s.mp.spawn(func() {
+			select {
+			case <-s.closed:
+			case <-s.mp.closed:
+				s.clLock.Lock()
+				s.markClosed()
+				s.clLock.Unlock()
+			}
+		})
+		if !ok {
+			// The session is already shutting down.
+			s.clLock.Lock()
+			s.markClosed()
+			s.clLock.Unlock()
+		}
+	})
+	return s.closed
+}
+
+// checkClosed marks the stream closed if both directions are. Must be called
+// with clLock held.
+func (s *Stream) checkClosed() {
+	if isClosedChan(s.readCancel) && isClosedChan(s.writeCancel) {
+		s.markClosed()
+	}
+}
+
+// markClosed must be called with clLock held.
+func (s *Stream) markClosed() {
+	if !isClosedChan(s.closed) {
+		close(s.closed)
+		if s.idleTimer != nil {
+			s.idleTimer.Stop()
+		}
+	}
+}
+
+// touch records activity on the stream, pushing back the idle timeout.
+func (s *Stream) touch() {
+	if s.idleTimer != nil && !isClosedChan(s.closed) {
+		s.idleTimer.Reset(s.mp.idleTimeout)
+	}
+}
+
 func (s *Stream) Reset() error {
-	s.cancelRead(ErrStreamReset)
+	return s.reset(ErrStreamReset)
+}
+
+// ResetWithError is like Reset, but makes our own pending and future reads and
+// writes on the stream fail with an error wrapping err, to tell them why the
+// stream was reset. The error also matches ErrStreamReset with errors.Is. The
+// mplex reset message can't carry a reason, so the peer just sees a reset.
+// With a nil err, it's the same as Reset.
+func (s *Stream) ResetWithError(err error) error {
+	if err == nil {
+		return s.Reset()
+	}
+	return s.reset(&resetError{err: err})
+}
+
+func (s *Stream) reset(err error) error {
+	s.cancelRead(err)
 
-	if s.cancelWrite(ErrStreamReset) {
+	if s.cancelWrite(err) {
 		// Send a reset in the background.
-		go s.mp.sendResetMsg(s.id.header(resetTag), true)
+		s.mp.spawn(func() { s.mp.sendResetMsg(s.id.header(ResetInitiatorTag), true) })
 	}
 
 	return nil